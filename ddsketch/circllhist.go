@@ -0,0 +1,97 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2018 Datadog, Inc.
+
+package ddsketch
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// CircllhistBin is a bin of a circllhist (OpenHistogram) log-linear histogram.
+// A bin with a positive Value covers [Value, Value+1) * 10^(Exp-1), one with a
+// negative Value covers (Value-1, Value] * 10^(Exp-1), and Value 0 stands for
+// zero. Nonzero values have two significant digits, from 10 to 99.
+type CircllhistBin struct {
+	Value int8
+	Exp   int8
+	Count uint64
+}
+
+// bounds returns the lowest and highest values of the bin, in absolute value.
+func (b CircllhistBin) bounds() (float64, float64) {
+	v := math.Abs(float64(b.Value))
+	scale := math.Pow(10, float64(b.Exp)-1)
+	return v * scale, (v + 1) * scale
+}
+
+// FromCircllhist builds a sketch configured with c from the bins of a circllhist
+// histogram, adding the count of each bin at its midpoint. As circllhist bins
+// are up to 10% wide, the values of the sketch are off by up to 5% of the
+// original values, in addition to the relative accuracy of c.
+func FromCircllhist(c *Config, bins []CircllhistBin) (*DDSketch, error) {
+	values := make([]WeightedValue, 0, len(bins))
+	for _, b := range bins {
+		if b.Value != 0 && (b.Value < -99 || b.Value > 99 || (b.Value > -10 && b.Value < 10)) {
+			return nil, fmt.Errorf("circllhist bin value %d is not a two-digit number", b.Value)
+		}
+		if b.Count > 0 {
+			values = append(values, WeightedValue{Value: circllhistMidpoint(b), Count: float64(b.Count)})
+		}
+	}
+	return NewDDSketchFromBins(c, values)
+}
+
+// ToCircllhist converts the sketch to the bins of a circllhist histogram, in
+// ascending value order, by adding the count of each bin of the sketch to the
+// circllhist bin of its representative value. Counts are rounded to integers.
+// Both the relative accuracy of the sketch and the width of circllhist bins, up
+// to 10%, bound the error of the result. The values whose exponent does not fit
+// in an int8 are counted in the closest bin: the zero bin below 1e-128 in
+// absolute value, and the bin of ±99e126 from 1e128.
+func ToCircllhist(s *DDSketch) []CircllhistBin {
+	type binKey struct{ value, exp int8 }
+	counts := make(map[binKey]float64)
+	s.ForEachBinValue(func(value, count float64) bool {
+		var k binKey
+		if math.Abs(value) >= 1e-128 {
+			e := math.Floor(math.Log10(math.Abs(value)))
+			v := math.Floor(math.Abs(value) / math.Pow(10, e-1))
+			// Correct the rounding errors of the logarithm.
+			if v >= 100 {
+				v, e = v/10, e+1
+			} else if v < 10 {
+				v, e = v*10, e-1
+			}
+			if e > math.MaxInt8 {
+				v, e = 99, math.MaxInt8
+			} else if e < math.MinInt8 {
+				v, e = 10, math.MinInt8
+			}
+			k = binKey{int8(math.Copysign(math.Floor(v), value)), int8(e)}
+		}
+		counts[k] += count
+		return false
+	})
+	bins := make([]CircllhistBin, 0, len(counts))
+	for k, count := range counts {
+		if n := uint64(math.Round(count)); n > 0 {
+			bins = append(bins, CircllhistBin{Value: k.value, Exp: k.exp, Count: n})
+		}
+	}
+	sort.Slice(bins, func(i, j int) bool {
+		return circllhistMidpoint(bins[i]) < circllhistMidpoint(bins[j])
+	})
+	return bins
+}
+
+func circllhistMidpoint(b CircllhistBin) float64 {
+	if b.Value == 0 {
+		return 0
+	}
+	lower, upper := b.bounds()
+	return math.Copysign((lower+upper)/2, float64(b.Value))
+}
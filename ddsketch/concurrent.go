@@ -0,0 +1,88 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2018 Datadog, Inc.
+
+package ddsketch
+
+import "sync"
+
+// ConcurrentDDSketch is a DDSketch that is safe for concurrent use. It is not
+// lock-free: additions and merges take a write lock, while queries share a read
+// lock. Quantile queries only hold it while taking a snapshot of the sketch.
+type ConcurrentDDSketch struct {
+	mu     sync.RWMutex
+	sketch *DDSketch
+}
+
+// NewConcurrentDDSketch allocates a new ConcurrentDDSketch, configured like
+// NewDDSketch.
+func NewConcurrentDDSketch(c *Config, opts ...Option) *ConcurrentDDSketch {
+	return &ConcurrentDDSketch{sketch: NewDDSketch(c, opts...)}
+}
+
+// Add a new value to the summary.
+func (s *ConcurrentDDSketch) Add(v float64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sketch.Add(v)
+}
+
+// AddWithCount adds count occurrences of value to the summary.
+func (s *ConcurrentDDSketch) AddWithCount(value, count float64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sketch.AddWithCount(value, count)
+}
+
+// Merge merges o into s. o is copied under its read lock first, so that merging
+// a sketch into itself does not deadlock.
+func (s *ConcurrentDDSketch) Merge(o *ConcurrentDDSketch) error {
+	o.mu.RLock()
+	src := o.sketch.MakeCopy()
+	o.mu.RUnlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sketch.Merge(src)
+}
+
+// MergeInto merges s into dst, which must not be used concurrently.
+func (s *ConcurrentDDSketch) MergeInto(dst *DDSketch) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return dst.Merge(s.sketch)
+}
+
+// Snapshot returns a copy of the sketch at this point in time, which can be
+// queried while values keep being added to s. The copy is taken under the read
+// lock and costs as much memory as the bins of the sketch, 8 bytes for each key
+// between the lowest and the highest one that the store covers.
+func (s *ConcurrentDDSketch) Snapshot() *DDSketch {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.sketch.MakeCopy()
+}
+
+// Quantile returns the estimate of the element at q, computed on a snapshot of
+// the sketch so that the bins are walked without holding the lock.
+func (s *ConcurrentDDSketch) Quantile(q float64) float64 {
+	return s.Snapshot().Quantile(q)
+}
+
+// Quantiles returns the estimates of the elements at each of qs, computed on a
+// snapshot of the sketch like Quantile.
+func (s *ConcurrentDDSketch) Quantiles(qs []float64) ([]float64, error) {
+	return s.Snapshot().Quantiles(qs)
+}
+
+func (s *ConcurrentDDSketch) Count() float64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.sketch.Count()
+}
+
+func (s *ConcurrentDDSketch) Sum() float64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.sketch.Sum()
+}
@@ -7,7 +7,7 @@ package ddsketch
 
 import (
 	"math"
-	"reflect"
+	"unsafe"
 )
 
 const (
@@ -32,10 +32,16 @@ func NewDefaultConfig() *Config {
 }
 
 func NewConfig(alpha float64, maxNumBins int, minValue float64) *Config {
+	return newConfigWithGamma(1+2*alpha/(1-alpha), math.Log1p(2*alpha/(1-alpha)), maxNumBins, minValue)
+}
+
+// newConfigWithGamma returns a configuration whose bins are the powers of
+// gamma, given along with its logarithm so that it can be exact.
+func newConfigWithGamma(gamma, gammaLn float64, maxNumBins int, minValue float64) *Config {
 	c := &Config{
 		maxNumBins: maxNumBins,
-		gamma:      1 + 2*alpha/(1-alpha),
-		gammaLn:    math.Log1p(2 * alpha / (1 - alpha)),
+		gamma:      gamma,
+		gammaLn:    gammaLn,
 		minValue:   minValue,
 	}
 	c.offset = -int(c.logGamma(c.minValue)) + 1
@@ -52,6 +58,53 @@ func (c *Config) Key(v float64) int {
 	}
 }
 
+// Keys returns the key of each of the values, in the same order. It gives the
+// same keys as calling Key on each value.
+func (c *Config) Keys(values []float64) []int {
+	keys := make([]int, len(values))
+	minValue, gammaLn, offset := c.minValue, c.gammaLn, c.offset
+	for i, v := range values {
+		if v < -minValue {
+			keys[i] = -int(math.Ceil(math.Log(-v)/gammaLn)) - offset
+		} else if v > minValue {
+			keys[i] = int(math.Ceil(math.Log(v)/gammaLn)) + offset
+		}
+	}
+	return keys
+}
+
+// Value returns the representative value of the bin at key.
+func (c *Config) Value(key int) float64 {
+	if key < 0 {
+		return -2 * c.powGamma(-key-c.offset) / (1 + c.gamma)
+	} else if key > 0 {
+		return 2 * c.powGamma(key-c.offset) / (1 + c.gamma)
+	}
+	return 0
+}
+
+// LowerBound returns the lowest value that maps to the bin at key. For positive
+// keys, the bound itself maps to the bin below.
+func (c *Config) LowerBound(key int) float64 {
+	if key < 0 {
+		return -c.powGamma(-key - c.offset)
+	} else if key > 0 {
+		return c.powGamma(key - c.offset - 1)
+	}
+	return -c.minValue
+}
+
+// UpperBound returns the highest value that maps to the bin at key. For
+// negative keys, the bound itself maps to the bin above.
+func (c *Config) UpperBound(key int) float64 {
+	if key < 0 {
+		return -c.powGamma(-key - c.offset - 1)
+	} else if key > 0 {
+		return c.powGamma(key - c.offset)
+	}
+	return c.minValue
+}
+
 func (c *Config) logGamma(v float64) float64 {
 	return math.Log(v) / c.gammaLn
 }
@@ -60,6 +113,12 @@ func (c *Config) powGamma(k int) float64 {
 	return math.Exp(float64(k) * c.gammaLn)
 }
 
+// compatible returns whether sketches configured with c and o map values to
+// the same keys.
+func (c *Config) compatible(o *Config) bool {
+	return c.gamma == o.gamma && c.minValue == o.minValue && c.offset == o.offset
+}
+
 func (c *Config) Size() int {
-	return int(reflect.TypeOf(*c).Size())
+	return int(unsafe.Sizeof(*c))
 }
@@ -0,0 +1,41 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2018 Datadog, Inc.
+
+package ddsketch
+
+import (
+	"encoding/csv"
+	"io"
+	"strconv"
+)
+
+// WriteHistogramCSV writes to w a header row followed by a row for each
+// nonzero bin of sketch, in ascending key order, with the key of the bin, the
+// bounds of the values that map to it and its count.
+func WriteHistogramCSV(w io.Writer, sketch *DDSketch) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"key", "lower_bound", "upper_bound", "count"}); err != nil {
+		return err
+	}
+	var err error
+	sketch.store.ForEach(func(key int, count float64) bool {
+		err = cw.Write([]string{
+			strconv.Itoa(key),
+			formatFloat(sketch.config.LowerBound(key)),
+			formatFloat(sketch.config.UpperBound(key)),
+			formatFloat(count),
+		})
+		return err != nil
+	})
+	if err != nil {
+		return err
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
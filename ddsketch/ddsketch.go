@@ -7,35 +7,441 @@ package ddsketch
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"iter"
 	"math"
-	"reflect"
+	"slices"
+	"sort"
+	"unsafe"
 )
 
 // DDSketch is an implementation of DDSketch.
+//
+// A single store holds the negative values, the values close to zero and the
+// positive values: the magnitude of negative values is mapped to keys below
+// -1, values within minValue of zero share the key 0, and positive values are
+// mapped to keys above 1. Key order is therefore value order, and quantiles
+// are computed across the three ranges without any stitching. The bins
+// between the lowest and highest keys count towards maxNumBins, so data that
+// spans both signs needs room for the magnitudes down to minValue on each side.
 type DDSketch struct {
-	config *Config
-	store  *Store
-	min    float64
-	max    float64
-	count  int64
-	sum    float64
+	config              *Config
+	store               *Store
+	min                 float64
+	max                 float64
+	count               float64
+	sum                 float64
+	representativeValue RepresentativeValueFunc
+	observer            Observer
+	invalidValuePolicy  InvalidValuePolicy
+	// sumSquares is the sum of the squares of the values, tracked only when
+	// exactSumSquares is set. exactSumSquares is cleared by merging a sketch
+	// that does not track it, and reset by Clear to wantExactSumSquares, which
+	// is set by WithExactSumOfSquares.
+	sumSquares          float64
+	exactSumSquares     bool
+	wantExactSumSquares bool
+	strictCollapse      bool
+	// The values are clamped to [rangeMin, rangeMax] when clampRange is set,
+	// and outOfRange counts the ones that were.
+	clampRange bool
+	rangeMin   float64
+	rangeMax   float64
+	outOfRange float64
+}
+
+// InvalidValuePolicy tells a sketch what to do with the NaN and infinite values
+// it is asked to add.
+type InvalidValuePolicy int
+
+const (
+	// RejectInvalidValues makes Add return an error wrapping ErrInvalidValue
+	// and leave the sketch unmodified. It is the default.
+	RejectInvalidValues InvalidValuePolicy = iota
+	// IgnoreInvalidValues makes Add skip the value.
+	IgnoreInvalidValues
+	// ClampInvalidValues makes Add replace +Inf with the largest float64 and
+	// -Inf with the smallest one, and pass them to Observer.OnClamp. NaN values
+	// are skipped, as there is nothing to clamp them to.
+	ClampInvalidValues
+)
+
+// Observer is notified of the internal events of a sketch.
+type Observer interface {
+	// OnCollapse is called when count values are folded into the lowest bin
+	// because the store reached its maximum number of bins.
+	OnCollapse(count float64)
+	// OnClamp is called when a nonzero value is too small in magnitude to be
+	// distinguished from zero, when a value is clamped to the range set by
+	// WithValueRange, and when an infinite value is clamped by
+	// ClampInvalidValues.
+	OnClamp(value float64)
+	// OnGrow is called when the bins of the store are reallocated, with
+	// their new capacity.
+	OnGrow(newCap int)
+}
+
+// RepresentativeValueFunc returns the value that stands for all the values of
+// a bin, given the bounds of the bin.
+type RepresentativeValueFunc func(lowerBound, upperBound float64) float64
+
+// Option configures a DDSketch at construction.
+type Option func(*DDSketch)
+
+// WithRepresentativeValue makes the sketch use f to compute the value of a bin
+// in the queries that return values. By default, the value of a bin is the
+// harmonic mean of its bounds, as returned by Config.Value.
+func WithRepresentativeValue(f RepresentativeValueFunc) Option {
+	return func(s *DDSketch) {
+		s.representativeValue = f
+	}
+}
+
+// LowerBoundValue is a RepresentativeValueFunc that returns the lower bound of
+// the bin. It under-estimates the sums reconstructed from the bins.
+func LowerBoundValue(lowerBound, upperBound float64) float64 {
+	return lowerBound
+}
+
+// UpperBoundValue is a RepresentativeValueFunc that returns the upper bound of
+// the bin. It over-estimates the sums reconstructed from the bins.
+func UpperBoundValue(lowerBound, upperBound float64) float64 {
+	return upperBound
+}
+
+// MidpointValue is a RepresentativeValueFunc that returns the arithmetic mean
+// of the bounds of the bin. It is unbiased if the values are spread evenly
+// within each bin.
+func MidpointValue(lowerBound, upperBound float64) float64 {
+	return lowerBound + (upperBound-lowerBound)/2
+}
+
+// GeometricMeanValue is a RepresentativeValueFunc that returns the geometric
+// mean of the bounds of the bin. If the values are spread evenly on a log scale,
+// as the bins are, it is the least biased of the representative values for the
+// sums reconstructed from the bins, ahead of the midpoint and of the default
+// harmonic mean.
+func GeometricMeanValue(lowerBound, upperBound float64) float64 {
+	return math.Copysign(math.Sqrt(lowerBound*upperBound), upperBound)
+}
+
+// WithObserver makes the sketch notify o of its internal events.
+func WithObserver(o Observer) Option {
+	return func(s *DDSketch) {
+		s.observer = o
+		s.store.observer = o
+	}
+}
+
+// WithInvalidValuePolicy sets what the sketch does with the NaN and infinite
+// values it is asked to add.
+func WithInvalidValuePolicy(p InvalidValuePolicy) Option {
+	return func(s *DDSketch) {
+		s.invalidValuePolicy = p
+	}
+}
+
+// WithExactSumOfSquares makes the sketch accumulate the sum of the squares of
+// its values, so that Variance and StdDev are exact rather than estimated from
+// the bins.
+func WithExactSumOfSquares() Option {
+	return func(s *DDSketch) {
+		s.exactSumSquares = true
+		s.wantExactSumSquares = true
+	}
+}
+
+// WithStrictCollapse makes Add and the other methods that add values return an
+// error wrapping ErrCollapse, rather than folding values into the lowest bin,
+// when the values do not fit in the maximum number of bins along with the ones
+// already in the sketch. It helps detecting a maxNumBins that is too small for
+// the range of the values. Merging still collapses the bins that do not fit.
+func WithStrictCollapse() Option {
+	return func(s *DDSketch) {
+		s.strictCollapse = true
+	}
+}
+
+// WithValueRange makes the sketch clamp the values it is asked to add to
+// [lo, hi] before mapping them to keys, so that a rare outlier neither widens
+// the bins nor collapses them. Clamped values are reported at the boundary they
+// were clamped to, by the quantiles as well as by Min, Max and Sum, and are
+// counted by OutOfRangeCount and passed to Observer.OnClamp. lo must not be
+// greater than hi.
+func WithValueRange(lo, hi float64) Option {
+	return func(s *DDSketch) {
+		s.clampRange = true
+		s.rangeMin, s.rangeMax = lo, hi
+	}
+}
+
+// WithExpectedMinValue positions the initial bins of the store at the key of
+// v, which avoids growing them when the values are expected to be clustered
+// just above v, far from 1.
+func WithExpectedMinValue(v float64) Option {
+	return func(s *DDSketch) {
+		store := NewStoreWithKeyHint(s.config.maxNumBins, s.config.Key(v))
+		store.observer = s.store.observer
+		s.store = store
+	}
 }
 
 // NewDDSketch allocates a new DDSketch summary with relative accuracy alpha.
-func NewDDSketch(c *Config) *DDSketch {
-	return &DDSketch{
+func NewDDSketch(c *Config, opts ...Option) *DDSketch {
+	s := &DDSketch{
 		config: c,
 		store:  NewStore(c.maxNumBins),
 		min:    math.Inf(1),
 		max:    math.Inf(-1),
 	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Add a new value to the summary. NaN and infinite values are handled according
+// to the InvalidValuePolicy of the sketch.
+func (s *DDSketch) Add(v float64) error {
+	v, ok, err := s.checkValue(v)
+	if ok {
+		return s.addWithCount(v, 1)
+	}
+	return err
+}
+
+// AddBatch adds all the values to the summary. It is equivalent to calling Add
+// on each value, but maps the values to keys and grows the store in one pass.
+// If one of the values is rejected, none of them is added.
+func (s *DDSketch) AddBatch(values []float64) error {
+	for _, v := range values {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			checked, err := s.checkValues(values)
+			if err != nil {
+				return err
+			}
+			values = checked
+			break
+		}
+	}
+	var outOfRange float64
+	if s.clampRange {
+		values, outOfRange = s.clampValues(values)
+	}
+	keys := s.config.Keys(values)
+	if s.strictCollapse && len(keys) > 0 {
+		if err := s.checkCollapse(slices.Min(keys), slices.Max(keys)); err != nil {
+			return err
+		}
+	}
+	s.store.AddBatch(keys)
+	s.outOfRange += outOfRange
+	for i, v := range values {
+		if keys[i] == 0 && v != 0 && s.observer != nil {
+			s.observer.OnClamp(v)
+		}
+		if v < s.min {
+			s.min = v
+		}
+		if s.max < v {
+			s.max = v
+		}
+		s.sum += v
+		if s.exactSumSquares {
+			s.sumSquares += v * v
+		}
+	}
+	s.count += float64(len(values))
+	return nil
+}
+
+// NewDDSketchFromBins allocates a new DDSketch, configured like NewDDSketch,
+// that holds the values of bins with their counts. It returns an error if one
+// of the values is NaN or infinite or one of the counts is not positive.
+func NewDDSketchFromBins(c *Config, bins []WeightedValue, opts ...Option) (*DDSketch, error) {
+	values := make([]float64, len(bins))
+	for i, b := range bins {
+		if math.IsNaN(b.Value) || math.IsInf(b.Value, 0) {
+			return nil, fmt.Errorf("%w: %g", ErrInvalidValue, b.Value)
+		}
+		if !(b.Count > 0) || math.IsInf(b.Count, 0) {
+			return nil, fmt.Errorf("invalid count %g for value %g", b.Count, b.Value)
+		}
+		values[i] = b.Value
+	}
+	s := NewDDSketch(c, opts...)
+	if len(bins) == 0 {
+		return s, nil
+	}
+	if s.clampRange {
+		for i, v := range values {
+			if v < s.rangeMin || v > s.rangeMax {
+				s.onClamp(v)
+				values[i] = math.Min(math.Max(v, s.rangeMin), s.rangeMax)
+				s.outOfRange += bins[i].Count
+			}
+		}
+	}
+	keys := c.Keys(values)
+	lo, hi := slices.Min(keys), slices.Max(keys)
+	if s.strictCollapse {
+		if err := s.checkCollapse(lo, hi); err != nil {
+			return nil, err
+		}
+	}
+	s.store.GrowTo(lo, hi)
+	for i, b := range bins {
+		s.addKeyWithCount(keys[i], values[i], b.Count)
+	}
+	return s, nil
+}
+
+// AddSeq adds all the values yielded by seq to the summary. It stops at the
+// first value that is rejected and returns the error.
+func (s *DDSketch) AddSeq(seq iter.Seq[float64]) error {
+	for v := range seq {
+		if err := s.Add(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddSeq2 adds all the values yielded by seq to the summary, each of them
+// with the count it is paired with. It stops at the first value or count that
+// is rejected and returns the error.
+func (s *DDSketch) AddSeq2(seq iter.Seq2[float64, float64]) error {
+	for v, count := range seq {
+		if err := s.AddWithCount(v, count); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddWithCount adds count occurrences of value to the summary. count may be
+// fractional but must be positive and finite. value is handled like in Add.
+func (s *DDSketch) AddWithCount(value, count float64) error {
+	if !(count > 0) || math.IsInf(count, 0) {
+		return fmt.Errorf("invalid count %g", count)
+	}
+	value, ok, err := s.checkValue(value)
+	if ok {
+		return s.addWithCount(value, count)
+	}
+	return err
+}
+
+// ErrInvalidValue is wrapped by the errors returned when adding a NaN or
+// infinite value to a sketch that rejects them.
+var ErrInvalidValue = errors.New("invalid value")
+
+// checkValue applies the InvalidValuePolicy of the sketch to v. It returns the
+// value to add and whether to add it.
+func (s *DDSketch) checkValue(v float64) (float64, bool, error) {
+	if !math.IsNaN(v) && !math.IsInf(v, 0) {
+		return v, true, nil
+	}
+	switch s.invalidValuePolicy {
+	case IgnoreInvalidValues:
+		return v, false, nil
+	case ClampInvalidValues:
+		if math.IsNaN(v) {
+			return v, false, nil
+		}
+		s.onClamp(v)
+		return math.Copysign(math.MaxFloat64, v), true, nil
+	}
+	return v, false, fmt.Errorf("%w: %g", ErrInvalidValue, v)
 }
 
-// Add a new value to the summary.
-func (s *DDSketch) Add(v float64) {
+// checkValues returns a copy of values with the InvalidValuePolicy of the
+// sketch applied, or the error of the first value that it rejects.
+func (s *DDSketch) checkValues(values []float64) ([]float64, error) {
+	checked := make([]float64, 0, len(values))
+	for _, v := range values {
+		v, ok, err := s.checkValue(v)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			checked = append(checked, v)
+		}
+	}
+	return checked, nil
+}
+
+// ErrCollapse is wrapped by the errors returned when adding values to a sketch
+// created with WithStrictCollapse would fold some values into the lowest bin.
+var ErrCollapse = errors.New("values do not fit in the maximum number of bins")
+
+// checkCollapse returns an error wrapping ErrCollapse if adding values at keys
+// lo to hi would collapse the store.
+func (s *DDSketch) checkCollapse(lo, hi int) error {
+	if s.store.wouldCollapse(lo, hi) {
+		return fmt.Errorf("%w: keys %d to %d with %d bins", ErrCollapse, lo, hi, s.config.maxNumBins)
+	}
+	return nil
+}
+
+// clampValues returns values clamped to the range of the sketch, copied if any
+// of them is out of it, along with the number of values that are.
+func (s *DDSketch) clampValues(values []float64) ([]float64, float64) {
+	var n float64
+	for i, v := range values {
+		if v >= s.rangeMin && v <= s.rangeMax {
+			continue
+		}
+		if n == 0 {
+			values = slices.Clone(values)
+		}
+		s.onClamp(v)
+		values[i] = math.Min(math.Max(v, s.rangeMin), s.rangeMax)
+		n++
+	}
+	return values, n
+}
+
+// clampValue returns v clamped to the range of the sketch, if it has one, and
+// whether it was out of it.
+func (s *DDSketch) clampValue(v float64) (float64, bool) {
+	if !s.clampRange || (v >= s.rangeMin && v <= s.rangeMax) {
+		return v, false
+	}
+	s.onClamp(v)
+	return math.Min(math.Max(v, s.rangeMin), s.rangeMax), true
+}
+
+func (s *DDSketch) addWithCount(v, count float64) error {
+	v, clamped := s.clampValue(v)
 	key := s.config.Key(v)
-	s.store.Add(key)
+	if s.strictCollapse {
+		if err := s.checkCollapse(key, key); err != nil {
+			return err
+		}
+	}
+	s.addKeyWithCount(key, v, count)
+	if clamped {
+		s.outOfRange += count
+	}
+	return nil
+}
+
+// onClamp notifies the observer of the sketch, if any, that v was clamped.
+func (s *DDSketch) onClamp(v float64) {
+	if s.observer != nil {
+		s.observer.OnClamp(v)
+	}
+}
+
+// addKeyWithCount is addWithCount for a value whose key is already known.
+func (s *DDSketch) addKeyWithCount(key int, v, count float64) {
+	if key == 0 && v != 0 && s.observer != nil {
+		s.observer.OnClamp(v)
+	}
+	s.store.AddWithCount(key, count)
 
 	// Keep track of summary stats
 	if v < s.min {
@@ -44,8 +450,20 @@ func (s *DDSketch) Add(v float64) {
 	if s.max < v {
 		s.max = v
 	}
-	s.count++
-	s.sum += v
+	s.count += count
+	s.sum += v * count
+	if s.exactSumSquares {
+		s.sumSquares += v * v * count
+	}
+}
+
+// ErrEmptySketch is returned by queries that are not defined on an empty sketch.
+var ErrEmptySketch = errors.New("no such element exists")
+
+// QuantileValue pairs a quantile with its estimated value.
+type QuantileValue struct {
+	Quantile float64
+	Value    float64
 }
 
 // Quantile returns the estimate of the element at q.
@@ -60,18 +478,320 @@ func (s *DDSketch) Quantile(q float64) float64 {
 		return s.max
 	}
 
-	rank := int(q*float64(s.count-1) + 1)
-	key := s.store.KeyAtRank(rank)
-	var quantile float64
-	if key < 0 {
-		key += s.config.offset
-		quantile = -2 * s.config.powGamma(-key) / (1 + s.config.gamma)
-	} else if key > 0 {
-		key -= s.config.offset
-		quantile = 2 * s.config.powGamma(key) / (1 + s.config.gamma)
-	} else {
-		quantile = 0
+	// All the values are in one bin if the min and the max are, which spares
+	// walking the store.
+	if key := s.config.Key(s.min); key == s.config.Key(s.max) {
+		return s.quantileAtKey(q, key)
+	}
+	return s.quantileAtKey(q, s.store.KeyAtWeightedRank(s.rank(q)))
+}
+
+// QuantileWithBounds returns the estimate of the element at q along with the
+// bounds of the bin that holds its rank, which the element is guaranteed to lie
+// within. The bounds are clamped to the min and max of the sketch. If the bin
+// holds collapsed values, the lower bound is widened to the min of the sketch
+// and collapsed is true: the relative accuracy guarantee does not hold for the
+// estimate. An error is only returned for an empty sketch or an invalid q.
+func (s *DDSketch) QuantileWithBounds(q float64) (value, lower, upper float64, collapsed bool, err error) {
+	if s.count == 0 {
+		return 0, 0, 0, false, ErrEmptySketch
+	}
+	if !(q >= 0 && q <= 1) {
+		return 0, 0, 0, false, fmt.Errorf("quantile %g is not in [0, 1]", q)
+	}
+	if q == 0 {
+		return s.min, s.min, s.min, false, nil
+	} else if q == 1 {
+		return s.max, s.max, s.max, false, nil
+	}
+	key := s.store.KeyAtWeightedRank(s.rank(q))
+	value = s.quantileAtKey(q, key)
+	lower = math.Max(s.min, s.config.LowerBound(key))
+	upper = math.Min(s.max, s.config.UpperBound(key))
+	if key == s.store.minKey && s.store.IsCollapsed() {
+		return value, s.min, upper, true, nil
 	}
+	return value, lower, upper, false, nil
+}
+
+// EstimatedRelativeError returns the relative error achieved by the estimate of
+// the element at q: the half-width of the bounds returned by QuantileWithBounds
+// divided by the absolute value of the estimate. It is usually lower than the
+// relative accuracy of the configuration, as the bounds are clamped to the min
+// and max of the sketch. In collapsed bins, the error is computed from the
+// widened bounds and collapsed is true. It is infinite if the estimate is zero
+// but the bounds are not.
+func (s *DDSketch) EstimatedRelativeError(q float64) (e float64, collapsed bool, err error) {
+	value, lower, upper, collapsed, err := s.QuantileWithBounds(q)
+	if err != nil {
+		return 0, false, err
+	}
+	if lower == upper {
+		return 0, collapsed, nil
+	}
+	return (upper - lower) / 2 / math.Abs(value), collapsed, nil
+}
+
+// Quantiles returns the estimates of the elements at each of qs, in the order
+// of qs. All the estimates are computed in a single walk of the bins.
+func (s *DDSketch) Quantiles(qs []float64) ([]float64, error) {
+	if s.count == 0 {
+		return nil, ErrEmptySketch
+	}
+	ranks := make([]float64, len(qs))
+	for i, q := range qs {
+		if !(q >= 0 && q <= 1) {
+			return nil, fmt.Errorf("quantile %g is not in [0, 1]", q)
+		}
+		ranks[i] = s.rank(q)
+	}
+	keys := s.store.KeysAtRanks(ranks)
+	values := make([]float64, len(qs))
+	for i, q := range qs {
+		values[i] = s.quantileAtKey(q, keys[i])
+	}
+	return values, nil
+}
+
+// QuantileTable returns the estimates of the elements at quantiles, paired with
+// their quantile. All the estimates are computed in a single walk of the bins.
+// If sorted is true, the rows are returned in ascending quantile order;
+// otherwise they follow the order of quantiles.
+func (s *DDSketch) QuantileTable(quantiles []float64, sorted bool) ([]QuantileValue, error) {
+	qs := quantiles
+	if sorted {
+		qs = make([]float64, len(quantiles))
+		copy(qs, quantiles)
+		sort.Float64s(qs)
+	}
+	values, err := s.Quantiles(qs)
+	if err != nil {
+		return nil, err
+	}
+	rows := make([]QuantileValue, len(qs))
+	for i, q := range qs {
+		rows[i] = QuantileValue{Quantile: q, Value: values[i]}
+	}
+	return rows, nil
+}
+
+// IsReliable returns whether the estimate of the element at quantile can be
+// trusted: the sketch must hold at least minCount values, and the bin that
+// holds the rank of quantile must not be the only populated one.
+func (s *DDSketch) IsReliable(minCount float64, quantile float64) bool {
+	if !(quantile >= 0 && quantile <= 1) || s.count == 0 || s.count < minCount {
+		return false
+	}
+	key := s.store.KeyAtWeightedRank(s.rank(quantile))
+	return s.store.bins[key-s.store.minKey] < s.count
+}
+
+// Rank returns the estimated number of values that are lower than or equal to
+// value. The bin that value maps to contributes like in CountBetween, in
+// proportion to the part of its range below value.
+func (s *DDSketch) Rank(value float64) float64 {
+	if s.count == 0 || value < s.min {
+		return 0
+	}
+	if value >= s.max {
+		return s.count
+	}
+	key := s.config.Key(value)
+	if key < s.store.minKey {
+		key = s.store.minKey
+	}
+	return s.store.CumulativeCount(key-1) + s.store.Count(key)*s.binFraction(key, math.Inf(-1), value)
+}
+
+// CDF returns the estimated fraction of the values that are lower than or
+// equal to value.
+func (s *DDSketch) CDF(value float64) (float64, error) {
+	if s.count == 0 {
+		return 0, ErrEmptySketch
+	}
+	if math.IsNaN(value) {
+		return 0, fmt.Errorf("%w: %g", ErrInvalidValue, value)
+	}
+	return s.Rank(value) / s.count, nil
+}
+
+// PercentileOf returns the percentile, from 0 to 100, that value stands at in
+// the sketch: 100 times CDF(value). It is the inverse of Quantile, which takes
+// a quantile from 0 to 1 and returns a value.
+func (s *DDSketch) PercentileOf(value float64) (float64, error) {
+	if math.IsInf(value, 0) {
+		return 0, fmt.Errorf("%w: %g", ErrInvalidValue, value)
+	}
+	cdf, err := s.CDF(value)
+	if err != nil {
+		return 0, err
+	}
+	return cdf * 100, nil
+}
+
+// CountBetween returns the estimated number of values between low and high,
+// inclusive. The bins that straddle low or high contribute in proportion to the
+// part of their range, narrowed to the min and max of the sketch, that lies
+// between them.
+func (s *DDSketch) CountBetween(low, high float64) (float64, error) {
+	if !(low <= high) {
+		return 0, fmt.Errorf("invalid value range [%g, %g]", low, high)
+	}
+	if s.count == 0 {
+		return 0, ErrEmptySketch
+	}
+	low, high = math.Max(low, s.min), math.Min(high, s.max)
+	if low > high {
+		return 0, nil
+	}
+	if low == s.min && high == s.max {
+		return s.count, nil
+	}
+	// The keys below the bins of the store are in the lowest bin, which holds
+	// the collapsed values, as in Rank.
+	lo := min(max(s.config.Key(low), s.store.minKey), s.store.maxKey)
+	hi := min(max(s.config.Key(high), s.store.minKey), s.store.maxKey)
+	var n float64
+	for key := lo; key <= hi; key++ {
+		if count := s.store.Count(key); count > 0 {
+			n += count * s.binFraction(key, low, high)
+		}
+	}
+	return n, nil
+}
+
+// binFraction returns the fraction of the range of the bin at key, narrowed to
+// the min and max of the sketch, that lies between low and high.
+func (s *DDSketch) binFraction(key int, low, high float64) float64 {
+	lower := math.Max(s.config.LowerBound(key), s.min)
+	if key == s.store.minKey {
+		// The lowest bin may hold collapsed values down to the min.
+		lower = s.min
+	}
+	upper := math.Min(s.config.UpperBound(key), s.max)
+	if upper <= lower {
+		if low <= lower && lower <= high {
+			return 1
+		}
+		return 0
+	}
+	f := (math.Min(upper, high) - math.Max(lower, low)) / (upper - lower)
+	return math.Max(0, math.Min(1, f))
+}
+
+// TrimmedMean returns the estimated mean of the values whose rank lies between
+// lowerQuantile*count and upperQuantile*count. The bins that straddle either
+// bound contribute in proportion to the part of their count within the bounds.
+func (s *DDSketch) TrimmedMean(lowerQuantile, upperQuantile float64) (float64, error) {
+	if !(lowerQuantile >= 0 && upperQuantile <= 1 && lowerQuantile < upperQuantile) {
+		return 0, fmt.Errorf("invalid quantile range [%g, %g]", lowerQuantile, upperQuantile)
+	}
+	if s.count == 0 {
+		return 0, ErrEmptySketch
+	}
+	lo, hi := lowerQuantile*s.count, upperQuantile*s.count
+	var n, sum, weight float64
+	s.store.ForEach(func(key int, count float64) bool {
+		w := math.Min(n+count, hi) - math.Max(n, lo)
+		n += count
+		if w > 0 {
+			v := math.Max(s.min, math.Min(s.max, s.value(key)))
+			sum += v * w
+			weight += w
+		}
+		return n >= hi
+	})
+	return sum / weight, nil
+}
+
+// IQR returns the estimated interquartile range, the difference between the
+// elements at 0.75 and 0.25. Both quartiles are estimated in a single walk of
+// the bins, each with the relative accuracy of the sketch.
+func (s *DDSketch) IQR() (float64, error) {
+	p25, p75, err := s.quartiles()
+	if err != nil {
+		return 0, err
+	}
+	return p75 - p25, nil
+}
+
+func (s *DDSketch) quartiles() (p25, p75 float64, err error) {
+	qs, err := s.Quantiles([]float64{0.25, 0.75})
+	if err != nil {
+		return 0, 0, err
+	}
+	return qs[0], qs[1], nil
+}
+
+// DefaultTukeyMultiplier is the multiplier of the IQR that Tukey used for the
+// fences beyond which values are outliers.
+const DefaultTukeyMultiplier = 1.5
+
+// TukeyFences returns the estimated Tukey fences of the values, p25 - k*IQR and
+// p75 + k*IQR, outside of which values are considered outliers. k is usually
+// DefaultTukeyMultiplier, or 3 to flag only the far outliers. The fences are
+// computed from estimated quartiles, so they inherit the relative accuracy of
+// the sketch, amplified by k: values close to a fence may be flagged
+// differently than by fences computed on the raw values.
+func (s *DDSketch) TukeyFences(k float64) (lower, upper float64, err error) {
+	if !(k >= 0) || math.IsInf(k, 1) {
+		return 0, 0, fmt.Errorf("invalid Tukey multiplier %g", k)
+	}
+	p25, p75, err := s.quartiles()
+	if err != nil {
+		return 0, 0, err
+	}
+	iqr := p75 - p25
+	return p25 - k*iqr, p75 + k*iqr, nil
+}
+
+// WeightedValue is the representative value of a bin along with its count.
+type WeightedValue struct {
+	Value float64
+	Count float64
+}
+
+// WeightedValues returns the representative value and the count of each
+// populated bin, in strictly ascending value order.
+func (s *DDSketch) WeightedValues() []WeightedValue {
+	var values []WeightedValue
+	s.ForEachBinValue(func(value, count float64) bool {
+		values = append(values, WeightedValue{Value: value, Count: count})
+		return false
+	})
+	return values
+}
+
+// ForEachBinValue calls f with the representative value and the count of each
+// populated bin, in strictly ascending value order, until f returns true.
+func (s *DDSketch) ForEachBinValue(f func(value, count float64) (stop bool)) {
+	s.store.ForEach(func(key int, count float64) bool {
+		return f(s.value(key), count)
+	})
+}
+
+// value returns the representative value of the bin at key.
+func (s *DDSketch) value(key int) float64 {
+	if s.representativeValue == nil || key == 0 {
+		return s.config.Value(key)
+	}
+	return s.representativeValue(s.config.LowerBound(key), s.config.UpperBound(key))
+}
+
+func (s *DDSketch) rank(q float64) float64 {
+	return q * (s.count - 1)
+}
+
+// quantileAtKey returns the estimate of the element at q, given the key of the
+// bin that holds its rank.
+func (s *DDSketch) quantileAtKey(q float64, key int) float64 {
+	if q == 0 {
+		return s.min
+	} else if q == 1 {
+		return s.max
+	}
+
+	quantile := s.value(key)
 	// Check that the returned value is larger than the minimum
 	// since for q close to 0 (key in the smallest bin) the midpoint
 	// of the bin boundaries could be smaller than the minimum
@@ -84,26 +804,123 @@ func (s *DDSketch) Quantile(q float64) float64 {
 	return quantile
 }
 
-// Merge another sketch (with the same maxNumBins and gamma) in place.
-func (s *DDSketch) Merge(o *DDSketch) {
+// ErrIncompatibleConfig is wrapped by the errors returned when combining
+// sketches that do not map values to the same keys.
+var ErrIncompatibleConfig = errors.New("incompatible configurations")
+
+// Merge another sketch in place. It returns an error, and leaves s unmodified,
+// if o does not map values to the same keys as s; ChangeMapping can convert o
+// beforehand.
+func (s *DDSketch) Merge(o *DDSketch) error {
+	if !s.config.compatible(o.config) {
+		return fmt.Errorf("cannot merge sketches with %w, convert one of them with ChangeMapping", ErrIncompatibleConfig)
+	}
 	if o.count == 0 {
-		return
+		return nil
 	}
 	if s.count == 0 {
-		s.store.Copy(o.store)
+		s.store.Merge(o.store)
 		s.count = o.count
 		s.sum = o.sum
+		s.sumSquares = o.sumSquares
+		s.exactSumSquares = s.exactSumSquares && o.exactSumSquares
+		s.outOfRange = o.outOfRange
 		s.min = o.min
 		s.max = o.max
-		return
+		return nil
 	}
 
 	// Merge the bins
 	s.store.Merge(o.store)
 
-	// Merge summary stats
+	s.mergeStats(o)
+	return nil
+}
+
+// MergeWithWeight merges o in place as if each of its values had been added
+// weight times, without modifying o. weight may be fractional but must be
+// positive and finite. Like Merge, it returns an error if o does not map values
+// to the same keys as s.
+func (s *DDSketch) MergeWithWeight(o *DDSketch, weight float64) error {
+	if !(weight > 0) || math.IsInf(weight, 0) {
+		return fmt.Errorf("invalid weight %g", weight)
+	}
+	if !s.config.compatible(o.config) {
+		return fmt.Errorf("cannot merge sketches with %w, convert one of them with ChangeMapping", ErrIncompatibleConfig)
+	}
+	if o.count == 0 {
+		return nil
+	}
+	collapsed := s.store.collapsed
+	o.store.ForEach(func(key int, count float64) bool {
+		s.store.AddWithCount(key, count*weight)
+		return false
+	})
+	s.store.addCollapsed(o.store, collapsed, o.store.collapsed*weight)
+	s.count += o.count * weight
+	s.sum += o.sum * weight
+	s.sumSquares += o.sumSquares * weight
+	s.exactSumSquares = s.exactSumSquares && o.exactSumSquares
+	s.outOfRange += o.outOfRange * weight
+	s.min = math.Min(s.min, o.min)
+	s.max = math.Max(s.max, o.max)
+	return nil
+}
+
+// MergeAll merges all of srcs into dst. It checks that they are all compatible
+// with dst before merging any of them, and grows the bins of dst once to cover
+// all the populated bins of srcs.
+func MergeAll(dst *DDSketch, srcs ...*DDSketch) error {
+	for _, src := range srcs {
+		if !dst.config.compatible(src.config) {
+			return fmt.Errorf("cannot merge sketches with %w, convert one of them with ChangeMapping", ErrIncompatibleConfig)
+		}
+	}
+	sketches := append([]*DDSketch{dst}, srcs...)
+	// The bins of the stores are the cheapest cover of their keys, as long as
+	// they fit in the bins of dst.
+	lo, hi := math.MaxInt, math.MinInt
+	for _, s := range sketches {
+		if s.store.count > 0 {
+			lo, hi = min(lo, s.store.minKey), max(hi, s.store.maxKey)
+		}
+	}
+	if lo > hi {
+		return nil
+	}
+	if hi-lo >= dst.store.maxNumBins {
+		// Otherwise, only the populated bins are covered, so that empty bins
+		// do not make dst collapse values.
+		lo, hi = math.MaxInt, math.MinInt
+		for _, s := range sketches {
+			s.store.ForEach(func(key int, count float64) bool {
+				lo = min(lo, key)
+				return true
+			})
+			s.store.ForEachReverse(func(key int, count float64) bool {
+				hi = max(hi, key)
+				return true
+			})
+		}
+	}
+	dst.store.GrowTo(lo, hi)
+	for _, src := range srcs {
+		if src.count == 0 {
+			continue
+		}
+		dst.store.addBins(src.store)
+		dst.mergeStats(src)
+	}
+	return nil
+}
+
+// mergeStats merges the summary stats of o into s.
+func (s *DDSketch) mergeStats(o *DDSketch) {
 	s.count += o.count
 	s.sum += o.sum
+	s.sumSquares += o.sumSquares
+	s.exactSumSquares = s.exactSumSquares && o.exactSumSquares
+	s.outOfRange += o.outOfRange
 	if o.min < s.min {
 		s.min = o.min
 	}
@@ -112,6 +929,274 @@ func (s *DDSketch) Merge(o *DDSketch) {
 	}
 }
 
+// MergeDedup merges each of sketches in place, skipping the ones whose
+// ContentHash matches one that has already been merged by this call. It stops
+// at the first sketch that cannot be merged and returns the error.
+func (s *DDSketch) MergeDedup(sketches []*DDSketch) error {
+	merged := make(map[uint64]struct{}, len(sketches))
+	for _, o := range sketches {
+		h := o.ContentHash()
+		if _, ok := merged[h]; ok {
+			continue
+		}
+		merged[h] = struct{}{}
+		if err := s.Merge(o); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ContentHash returns a hash of the configuration and of the nonzero bins of
+// the sketch. It is meant to detect duplicate sketches, not for security: it
+// only depends on the content of the sketch, not on how its bins are laid out
+// in memory.
+func (s *DDSketch) ContentHash() uint64 {
+	h := fnv.New64a()
+	writeUint64(h, math.Float64bits(s.config.gamma))
+	writeUint64(h, math.Float64bits(s.config.minValue))
+	writeUint64(h, uint64(s.config.offset))
+	s.store.hashBins(h)
+	return h.Sum64()
+}
+
+// SplitAt partitions the bins of the sketch into a sketch of the values below
+// value and a sketch of the values at or above value. The bin that value maps
+// to is assigned as a whole to the side that covers the larger part of its
+// range, and the collapsed values go with the lowest bin. The counts of both
+// halves are exact, but their sums, as well as the max of below and the min of
+// above, are estimated from the bins. The resulting sketches share the
+// configuration of the source sketch.
+func (s *DDSketch) SplitAt(value float64) (below, above *DDSketch, err error) {
+	if math.IsNaN(value) {
+		return nil, nil, errors.New("cannot split a sketch at NaN")
+	}
+	below = s.newEmpty()
+	above = s.newEmpty()
+	splitKey := s.config.Key(value)
+	if value-s.config.LowerBound(splitKey) > s.config.UpperBound(splitKey)-value {
+		splitKey++
+	}
+	for i, b := range s.store.bins {
+		if b == 0 {
+			continue
+		}
+		key := i + s.store.minKey
+		dst := above
+		if key < splitKey {
+			dst = below
+		}
+		dst.store.AddWithCount(key, b)
+		dst.count += b
+		dst.sum += s.value(key) * b
+		if dst.min == math.Inf(1) {
+			dst.min = math.Max(s.min, s.config.LowerBound(key))
+		}
+		dst.max = math.Min(s.max, s.config.UpperBound(key))
+	}
+	// The collapsed values are in the lowest bin, which the halves do not fold.
+	if s.store.minKey < splitKey {
+		below.store.collapsed = s.store.collapsed
+	} else {
+		above.store.collapsed = s.store.collapsed
+	}
+	below.exactSumSquares = false
+	above.exactSumSquares = false
+	if below.count > 0 {
+		below.min = s.min
+	}
+	if above.count > 0 {
+		above.max = s.max
+	}
+	switch {
+	case below.count == 0:
+		above.sum = s.sum
+	case above.count == 0:
+		below.sum = s.sum
+	default:
+		above.sum = s.sum - below.sum
+	}
+	return below, above, nil
+}
+
+// Decay multiplies the counts of the sketch by factor, which must be in (0, 1],
+// so that older values weigh less than the ones added afterwards. The bins whose
+// count is then lower than pruneBelow are removed to bound the memory used by
+// the sketch. Once bins have been removed, the sum of the sketch is estimated
+// from their representative values, the sum of squares is no longer exact, and
+// the min and max are bounded by the remaining bins.
+func (s *DDSketch) Decay(factor, pruneBelow float64) error {
+	if !(factor > 0 && factor <= 1) {
+		return fmt.Errorf("decay factor %g is not in (0, 1]", factor)
+	}
+	if s.count == 0 {
+		return nil
+	}
+	if err := s.store.Reweight(factor); err != nil {
+		return err
+	}
+	s.count *= factor
+	s.sum *= factor
+	s.sumSquares *= factor
+	var prunedSum float64
+	s.store.ForEach(func(key int, count float64) bool {
+		if count < pruneBelow {
+			prunedSum += s.value(key) * count
+		}
+		return false
+	})
+	if s.store.Prune(pruneBelow) == 0 {
+		return nil
+	}
+	if s.store.count == 0 {
+		s.Clear()
+		return nil
+	}
+	s.count = s.store.count
+	s.sum -= prunedSum
+	s.exactSumSquares = false
+	s.boundMinMaxByBins()
+	return nil
+}
+
+// boundMinMaxByBins narrows the min and max of the sketch to the bounds of its
+// lowest and highest populated bins, after bins have been removed.
+func (s *DDSketch) boundMinMaxByBins() {
+	s.store.ForEach(func(key int, count float64) bool {
+		s.min = math.Max(s.min, s.config.LowerBound(key))
+		return true
+	})
+	s.store.ForEachReverse(func(key int, count float64) bool {
+		s.max = math.Min(s.max, s.config.UpperBound(key))
+		return true
+	})
+}
+
+// Subtract removes the values of o from the sketch, bin by bin. Counts that
+// would become negative are clamped to zero. It is approximate, and only
+// meaningful if s was built by merging o with other values: subtracting a
+// sketch that s is not derived from is undefined. If clamping happened, the
+// sum is estimated from the remaining bins and the sum of squares is no longer
+// exact; the min and max are bounded by the remaining bins either way.
+func (s *DDSketch) Subtract(o *DDSketch) error {
+	if !s.config.compatible(o.config) {
+		return fmt.Errorf("cannot subtract sketches with %w, convert one of them with ChangeMapping", ErrIncompatibleConfig)
+	}
+	if o.count == 0 || s.count == 0 {
+		return nil
+	}
+	removed := s.store.Subtract(o.store)
+	if s.store.count == 0 {
+		s.Clear()
+		return nil
+	}
+	s.count = s.store.count
+	if removed == o.count {
+		s.sum -= o.sum
+		s.sumSquares -= o.sumSquares
+	} else {
+		s.sum = 0
+		s.ForEachBinValue(func(value, count float64) bool {
+			s.sum += value * count
+			return false
+		})
+		s.exactSumSquares = false
+	}
+	s.boundMinMaxByBins()
+	return nil
+}
+
+// ChangeMapping returns a copy of the sketch that uses the configuration c, with
+// all its values multiplied by scaleFactor. The representative value of each
+// bin is mapped to a key of c, so the relative error of the result is bounded
+// by the sum of the relative accuracies of s and c: converting can only lose
+// accuracy. It is meant to convert a sketch to a coarser configuration before
+// merging it with sketches that use that configuration.
+func (s *DDSketch) ChangeMapping(c *Config, scaleFactor float64) *DDSketch {
+	d := s.newEmpty()
+	d.config = c
+	d.store = NewStore(c.maxNumBins)
+	d.store.observer = s.observer
+	if s.count == 0 {
+		return d
+	}
+	s.store.ForEach(func(key int, count float64) bool {
+		d.store.AddWithCount(c.Key(s.value(key)*scaleFactor), count)
+		return false
+	})
+	d.count = s.count
+	d.sum = s.sum * scaleFactor
+	d.sumSquares = s.sumSquares * scaleFactor * scaleFactor
+	d.exactSumSquares = s.exactSumSquares
+	d.min, d.max = s.min*scaleFactor, s.max*scaleFactor
+	if scaleFactor < 0 {
+		d.min, d.max = d.max, d.min
+	}
+	return d
+}
+
+// NumBins returns the number of nonzero bins of the sketch.
+func (s *DDSketch) NumBins() int {
+	return s.store.NumBins()
+}
+
+// CollapsedCount returns the number of values whose bins have been collapsed
+// into the lowest one because the store reached its maximum number of bins.
+func (s *DDSketch) CollapsedCount() float64 {
+	return s.store.CollapsedCount()
+}
+
+// OutOfRangeCount returns the number of values that have been clamped to the
+// range set with WithValueRange.
+func (s *DDSketch) OutOfRangeCount() float64 {
+	return s.outOfRange
+}
+
+// AggregateCollapsedFraction returns the fraction of the values of the sketch
+// that have been collapsed, either by its own store or by the stores of the
+// sketches merged into it. The estimates of the quantiles below that fraction
+// do not meet the relative accuracy guarantee. It returns zero for an empty
+// sketch.
+func (s *DDSketch) AggregateCollapsedFraction() float64 {
+	if s.count == 0 {
+		return 0
+	}
+	return s.store.collapsed / s.count
+}
+
+// Clear empties the sketch, keeping its configuration, its options and the
+// capacity of its store so that it can be reused.
+func (s *DDSketch) Clear() {
+	s.store.Clear()
+	s.count = 0
+	s.sum = 0
+	s.sumSquares = 0
+	s.exactSumSquares = s.wantExactSumSquares
+	s.outOfRange = 0
+	s.min = math.Inf(1)
+	s.max = math.Inf(-1)
+}
+
+// Min returns the smallest value added to the sketch. Unlike Quantile(0), it is
+// exact.
+func (s *DDSketch) Min() (float64, error) {
+	if s.count == 0 {
+		return 0, ErrEmptySketch
+	}
+	return s.min, nil
+}
+
+// Max returns the largest value added to the sketch. Unlike Quantile(1), it is
+// exact.
+func (s *DDSketch) Max() (float64, error) {
+	if s.count == 0 {
+		return 0, ErrEmptySketch
+	}
+	return s.max, nil
+}
+
+// Sum returns the sum of the values added to the sketch. It is accumulated as
+// values are added and merged, not estimated from the bins.
 func (s *DDSketch) Sum() float64 {
 	return s.sum
 }
@@ -120,10 +1205,55 @@ func (s *DDSketch) Avg() float64 {
 	return s.sum / float64(s.count)
 }
 
-func (s *DDSketch) Count() int64 {
+// HasExactStats returns whether the sketch tracks the sum of the squares of its
+// values, which makes Variance and StdDev exact.
+func (s *DDSketch) HasExactStats() bool {
+	return s.exactSumSquares
+}
+
+// Variance returns the population variance of the values. It is exact if the
+// sketch was constructed with WithExactSumOfSquares and estimated from the
+// representative values of the bins otherwise.
+func (s *DDSketch) Variance() (float64, error) {
+	if s.count == 0 {
+		return 0, ErrEmptySketch
+	}
+	if s.exactSumSquares {
+		mean := s.sum / s.count
+		return math.Max(0, s.sumSquares/s.count-mean*mean), nil
+	}
+	values := s.WeightedValues()
+	var mean float64
+	for _, wv := range values {
+		mean += wv.Value * wv.Count
+	}
+	mean /= s.count
+	var variance float64
+	for _, wv := range values {
+		d := wv.Value - mean
+		variance += d * d * wv.Count
+	}
+	return variance / s.count, nil
+}
+
+// StdDev returns the population standard deviation of the values, with the
+// same exactness as Variance.
+func (s *DDSketch) StdDev() (float64, error) {
+	variance, err := s.Variance()
+	if err != nil {
+		return 0, err
+	}
+	return math.Sqrt(variance), nil
+}
+
+// Count returns the number of values added to the sketch, weighted by their
+// counts. Like Sum, it is exact.
+func (s *DDSketch) Count() float64 {
 	return s.count
 }
 
+// MakeCopy returns a deep copy of the sketch, with its own store, config and
+// stats, and the same options. Modifying the copy does not affect s.
 func (s *DDSketch) MakeCopy() *DDSketch {
 	store := s.store.MakeCopy()
 	config := &Config{
@@ -134,19 +1264,52 @@ func (s *DDSketch) MakeCopy() *DDSketch {
 		offset:     s.config.offset,
 	}
 	return &DDSketch{
-		config: config,
-		store:  store,
-		min:    s.min,
-		max:    s.max,
-		count:  s.count,
-		sum:    s.sum,
+		config:              config,
+		store:               store,
+		min:                 s.min,
+		max:                 s.max,
+		count:               s.count,
+		sum:                 s.sum,
+		representativeValue: s.representativeValue,
+		observer:            s.observer,
+		invalidValuePolicy:  s.invalidValuePolicy,
+		sumSquares:          s.sumSquares,
+		exactSumSquares:     s.exactSumSquares,
+		wantExactSumSquares: s.wantExactSumSquares,
+		strictCollapse:      s.strictCollapse,
+		clampRange:          s.clampRange,
+		rangeMin:            s.rangeMin,
+		rangeMax:            s.rangeMax,
+		outOfRange:          s.outOfRange,
+	}
+}
+
+// newEmpty returns an empty sketch that shares the configuration and the
+// options of s.
+func (s *DDSketch) newEmpty() *DDSketch {
+	store := NewStore(s.config.maxNumBins)
+	store.observer = s.observer
+	return &DDSketch{
+		config:              s.config,
+		store:               store,
+		min:                 math.Inf(1),
+		max:                 math.Inf(-1),
+		representativeValue: s.representativeValue,
+		observer:            s.observer,
+		invalidValuePolicy:  s.invalidValuePolicy,
+		exactSumSquares:     s.wantExactSumSquares,
+		wantExactSumSquares: s.wantExactSumSquares,
+		strictCollapse:      s.strictCollapse,
+		clampRange:          s.clampRange,
+		rangeMin:            s.rangeMin,
+		rangeMax:            s.rangeMax,
 	}
 }
 
 func (s *DDSketch) String() string {
 	var buffer bytes.Buffer
 	buffer.WriteString(fmt.Sprintf("offset: %d ", s.config.offset))
-	buffer.WriteString(fmt.Sprintf("count: %d ", s.count))
+	buffer.WriteString(fmt.Sprintf("count: %g ", s.count))
 	buffer.WriteString(fmt.Sprintf("sum: %g ", s.sum))
 	buffer.WriteString(fmt.Sprintf("min: %g ", s.min))
 	buffer.WriteString(fmt.Sprintf("max: %g ", s.max))
@@ -154,6 +1317,12 @@ func (s *DDSketch) String() string {
 	return buffer.String()
 }
 
+// ApproximateMemoryUsage returns the number of bytes held by the sketch, its
+// store and its configuration.
+func (s *DDSketch) ApproximateMemoryUsage() int {
+	return int(unsafe.Sizeof(*s)) + s.store.ApproximateMemoryUsage() + s.config.Size()
+}
+
 func (s *DDSketch) MemorySize() int {
-	return int(reflect.TypeOf(*s).Size()) + s.store.Size() + s.config.Size()
+	return s.ApproximateMemoryUsage()
 }
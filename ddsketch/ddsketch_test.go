@@ -6,6 +6,15 @@
 package ddsketch
 
 import (
+	"bytes"
+	"encoding/csv"
+	"encoding/gob"
+	"encoding/json"
+	"math"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
 	"testing"
 
 	"github.com/DataDog/sketches-go/dataset"
@@ -58,7 +67,7 @@ func AssertSketchesAccurate(t *testing.T, d *dataset.Dataset, g *DDSketch, c *Co
 	assert.Equal(d.Min(), g.min)
 	assert.Equal(d.Max(), g.max)
 	assert.InEpsilon(d.Sum(), g.sum, eps)
-	assert.Equal(d.Count, g.count)
+	assert.Equal(float64(d.Count), g.count)
 }
 
 func TestConstant(t *testing.T) {
@@ -203,3 +212,2259 @@ func TestConsistentQuantile(t *testing.T) {
 		assert.Equal(t, q1, q2)
 	}
 }
+
+func TestConfigBounds(t *testing.T) {
+	assert := assert.New(t)
+	c := NewConfig(testAlpha, testMaxBins, testMinValue)
+	for _, v := range []float64{-1e6, -3.5, -testMinValue * 2, 0, testMinValue * 2, 0.02, 1, 42, 1e9} {
+		key := c.Key(v)
+		lower, upper := c.LowerBound(key), c.UpperBound(key)
+		assert.True(lower <= v && v <= upper, "value %g", v)
+		assert.True(lower <= c.Value(key) && c.Value(key) <= upper, "value %g", v)
+		if key != 0 {
+			assert.InEpsilon(c.gamma, math.Max(upper/lower, lower/upper), 1e-9)
+		}
+	}
+	assert.Equal(c.UpperBound(5), c.LowerBound(6))
+	assert.Equal(c.UpperBound(-6), c.LowerBound(-5))
+}
+
+func TestConfigKeyPowersOfGamma(t *testing.T) {
+	assert := assert.New(t)
+	for _, alpha := range []float64{0.01, 0.02, 0.05} {
+		c := NewConfig(alpha, testMaxBins, testMinValue)
+		values := make([]float64, 1000)
+		for i := range values {
+			values[i] = math.Pow(c.gamma, float64(i+1))
+		}
+		keys := c.Keys(values)
+		for i, v := range values {
+			// The keys of existing sketches were computed by dividing by the
+			// logarithm of gamma, which rounds differently than multiplying
+			// by its inverse.
+			expected := int(math.Ceil(math.Log(v)/c.gammaLn)) + c.offset
+			assert.Equal(expected, c.Key(v), "alpha %g, value %g", alpha, v)
+			assert.Equal(expected, keys[i], "alpha %g, value %g", alpha, v)
+		}
+	}
+}
+
+func TestQuantileSingleBin(t *testing.T) {
+	assert := assert.New(t)
+	c := NewConfig(testAlpha, testMaxBins, testMinValue)
+	s := NewDDSketch(c)
+	assert.True(math.IsNaN(s.Quantile(0.5)))
+	s.Add(100)
+	s.Add(100.5)
+	assert.Equal(1, s.NumBins())
+	assert.Equal(100.0, s.Quantile(0))
+	assert.Equal(math.Min(100.5, c.Value(c.Key(100))), s.Quantile(0.5))
+	assert.Equal(100.5, s.Quantile(1))
+	values, _ := s.Quantiles([]float64{0, 0.5, 1})
+	assert.Equal([]float64{s.Quantile(0), s.Quantile(0.5), s.Quantile(1)}, values)
+}
+
+func BenchmarkQuantileSingleBin(b *testing.B) {
+	s := NewDDSketch(NewDefaultConfig())
+	s.Add(100)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.Quantile(0.25)
+	}
+}
+
+func TestQuantileTable(t *testing.T) {
+	assert := assert.New(t)
+	c := NewConfig(testAlpha, testMaxBins, testMinValue)
+	s := NewDDSketch(c)
+	_, err := s.QuantileTable(testQuantiles, false)
+	assert.Equal(ErrEmptySketch, err)
+
+	generator := dataset.NewExponential(2)
+	for i := 0; i < 1000; i++ {
+		s.Add(generator.Generate())
+	}
+	qs := []float64{0.99, 0, 0.5, 1, 0.25}
+	rows, err := s.QuantileTable(qs, false)
+	assert.Nil(err)
+	for i, q := range qs {
+		assert.Equal(q, rows[i].Quantile)
+		assert.Equal(s.Quantile(q), rows[i].Value)
+	}
+	rows, err = s.QuantileTable(qs, true)
+	assert.Nil(err)
+	assert.Equal([]float64{0.99, 0, 0.5, 1, 0.25}, qs)
+	for i, q := range []float64{0, 0.25, 0.5, 0.99, 1} {
+		assert.Equal(q, rows[i].Quantile)
+		assert.Equal(s.Quantile(q), rows[i].Value)
+	}
+
+	_, err = s.QuantileTable([]float64{0.5, 1.5}, false)
+	assert.Error(err)
+}
+
+func TestQuantileWithBounds(t *testing.T) {
+	assert := assert.New(t)
+	c := NewConfig(testAlpha, testMaxBins, testMinValue)
+	s := NewDDSketch(c)
+	_, _, _, _, err := s.QuantileWithBounds(0.5)
+	assert.ErrorIs(err, ErrEmptySketch)
+
+	generator := dataset.NewLognormal(0, 1)
+	for i := 0; i < 1000; i++ {
+		s.Add(generator.Generate())
+	}
+	for _, q := range testQuantiles {
+		value, lower, upper, collapsed, err := s.QuantileWithBounds(q)
+		assert.Nil(err)
+		assert.False(collapsed)
+		assert.Equal(s.Quantile(q), value)
+		assert.True(lower <= value && value <= upper)
+		assert.True(upper <= lower*c.gamma*(1+1e-9))
+	}
+	_, _, _, _, err = s.QuantileWithBounds(2)
+	assert.Error(err)
+	_, _, _, _, err = s.QuantileWithBounds(math.NaN())
+	assert.Error(err)
+
+	// With few bins, the lowest quantiles fall in the collapsed bin.
+	collapsed := NewDDSketch(NewConfig(testAlpha, 10, testMinValue))
+	for v := 1; v <= 1000; v++ {
+		collapsed.Add(float64(v))
+	}
+	value, lower, upper, isCollapsed, err := collapsed.QuantileWithBounds(0.1)
+	assert.Nil(err)
+	assert.True(isCollapsed)
+	assert.Equal(1.0, lower)
+	assert.True(lower <= value && value <= upper)
+	_, _, _, isCollapsed, err = collapsed.QuantileWithBounds(0.999)
+	assert.Nil(err)
+	assert.False(isCollapsed)
+}
+
+func TestEstimatedRelativeError(t *testing.T) {
+	assert := assert.New(t)
+	c := NewConfig(testAlpha, testMaxBins, testMinValue)
+	s := NewDDSketch(c)
+	_, _, err := s.EstimatedRelativeError(0.5)
+	assert.ErrorIs(err, ErrEmptySketch)
+
+	generator := dataset.NewLognormal(0, 1)
+	for i := 0; i < 1000; i++ {
+		s.Add(generator.Generate())
+	}
+	for _, q := range testQuantiles {
+		e, collapsed, err := s.EstimatedRelativeError(q)
+		assert.Nil(err)
+		assert.False(collapsed)
+		assert.True(e >= 0)
+		assert.True(e <= testAlpha/(1-testAlpha*testAlpha)*(1+1e-9))
+	}
+	e, _, _ := s.EstimatedRelativeError(0)
+	assert.Equal(0.0, e)
+	_, _, err = s.EstimatedRelativeError(-1)
+	assert.Error(err)
+
+	collapsed := NewDDSketch(NewConfig(testAlpha, 10, testMinValue))
+	for v := 1; v <= 1000; v++ {
+		collapsed.Add(float64(v))
+	}
+	e, isCollapsed, err := collapsed.EstimatedRelativeError(0.1)
+	assert.Nil(err)
+	assert.True(isCollapsed)
+	assert.True(e > testAlpha)
+	e, isCollapsed, err = collapsed.EstimatedRelativeError(0.999)
+	assert.Nil(err)
+	assert.False(isCollapsed)
+	assert.True(e <= testAlpha/(1-testAlpha*testAlpha)*(1+1e-9))
+}
+
+func TestQuantiles(t *testing.T) {
+	assert := assert.New(t)
+	c := NewConfig(testAlpha, testMaxBins, testMinValue)
+	s := NewDDSketch(c)
+	_, err := s.Quantiles(testQuantiles)
+	assert.ErrorIs(err, ErrEmptySketch)
+
+	generator := dataset.NewNormal(-20, 5)
+	for i := 0; i < 1000; i++ {
+		s.Add(generator.Generate())
+	}
+	qs := []float64{0.5, 1, 0.01, 0, 0.99, 0.5}
+	values, err := s.Quantiles(qs)
+	assert.Nil(err)
+	for i, q := range qs {
+		assert.Equal(s.Quantile(q), values[i])
+	}
+	_, err = s.Quantiles([]float64{0.5, -0.1})
+	assert.EqualError(err, "quantile -0.1 is not in [0, 1]")
+	_, err = s.Quantiles([]float64{math.NaN()})
+	assert.EqualError(err, "quantile NaN is not in [0, 1]")
+}
+
+func TestAddSeq(t *testing.T) {
+	assert := assert.New(t)
+	c := NewConfig(testAlpha, testMaxBins, testMinValue)
+	generator := dataset.NewLognormal(0, 2)
+	values := make([]float64, 1000)
+	for i := range values {
+		values[i] = generator.Generate()
+	}
+
+	s1 := NewDDSketch(c)
+	s2 := NewDDSketch(c)
+	s3 := NewDDSketch(c)
+	for _, v := range values {
+		s1.Add(v)
+		s1.Add(v)
+	}
+	s2.AddSeq(func(yield func(float64) bool) {
+		for _, v := range append(values, values...) {
+			if !yield(v) {
+				return
+			}
+		}
+	})
+	s3.AddSeq2(func(yield func(float64, float64) bool) {
+		for _, v := range values {
+			if !yield(v, 2) {
+				return
+			}
+		}
+	})
+	for _, s := range []*DDSketch{s2, s3} {
+		assert.Equal(s1.Count(), s.Count())
+		assert.Equal(s1.min, s.min)
+		assert.Equal(s1.max, s.max)
+		for _, q := range testQuantiles {
+			assert.Equal(s1.Quantile(q), s.Quantile(q))
+		}
+	}
+}
+
+func TestAddBatch(t *testing.T) {
+	assert := assert.New(t)
+	c := NewConfig(testAlpha, testMaxBins, testMinValue)
+	generator := dataset.NewNormal(0, 100)
+	values := make([]float64, 10000)
+	for i := range values {
+		values[i] = generator.Generate()
+	}
+	values = append(values, 0, testMinValue/2, -testMinValue/2)
+
+	keys := c.Keys(values)
+	for i, v := range values {
+		assert.Equal(c.Key(v), keys[i])
+	}
+
+	s1 := NewDDSketch(c)
+	s2 := NewDDSketch(c)
+	for _, v := range values {
+		s1.Add(v)
+	}
+	s2.AddBatch(values)
+	assert.Equal(s1.Count(), s2.Count())
+	assert.Equal(s1.Sum(), s2.Sum())
+	assert.Equal(s1.min, s2.min)
+	assert.Equal(s1.max, s2.max)
+	assert.True(StoresEqual(s1.store, s2.store, 0, false))
+}
+
+func TestAddWithCount(t *testing.T) {
+	assert := assert.New(t)
+	c := NewConfig(testAlpha, testMaxBins, testMinValue)
+	s := NewDDSketch(c)
+	assert.Nil(s.AddWithCount(10, 37.5))
+	assert.Nil(s.AddWithCount(20, 2.5))
+	assert.Equal(40.0, s.Count())
+	assert.Equal(425.0, s.Sum())
+	assert.Equal(37.5, s.store.Count(c.Key(10)))
+	assert.InEpsilon(10, s.Quantile(0.5), testAlpha)
+
+	for _, count := range []float64{0, -1, math.NaN(), math.Inf(1)} {
+		assert.Error(s.AddWithCount(1, count))
+	}
+	assert.ErrorIs(s.AddWithCount(math.NaN(), 1), ErrInvalidValue)
+	assert.Equal(40.0, s.Count())
+}
+
+func TestNewDDSketchFromBins(t *testing.T) {
+	assert := assert.New(t)
+	c := NewConfig(testAlpha, testMaxBins, testMinValue)
+	bins := []WeightedValue{{Value: 5, Count: 70}, {Value: 1, Count: 10}, {Value: 0.5, Count: 20.5}}
+	s, err := NewDDSketchFromBins(c, bins, WithExactSumOfSquares())
+	assert.Nil(err)
+	assert.True(s.HasExactStats())
+	expected := NewDDSketch(c)
+	for _, b := range bins {
+		expected.AddWithCount(b.Value, b.Count)
+	}
+	assert.Equal(expected.Count(), s.Count())
+	assert.Equal(expected.Sum(), s.Sum())
+	assert.Equal(0.5, s.min)
+	assert.Equal(5.0, s.max)
+	assert.True(StoresEqual(expected.store, s.store, 0, false))
+	assert.InEpsilon(0.5, s.Quantile(0.1), testAlpha)
+	assert.InEpsilon(1, s.Quantile(0.25), testAlpha)
+	assert.InEpsilon(5, s.Quantile(0.5), testAlpha)
+
+	s, err = NewDDSketchFromBins(c, nil)
+	assert.Nil(err)
+	assert.Equal(0.0, s.Count())
+	_, err = NewDDSketchFromBins(c, []WeightedValue{{Value: 1, Count: 1}, {Value: math.Inf(1), Count: 1}})
+	assert.ErrorIs(err, ErrInvalidValue)
+	_, err = NewDDSketchFromBins(c, []WeightedValue{{Value: 1, Count: 0}})
+	assert.Error(err)
+}
+
+func TestInvalidValuePolicy(t *testing.T) {
+	assert := assert.New(t)
+	c := NewConfig(testAlpha, testMaxBins, testMinValue)
+	invalid := []float64{math.NaN(), math.Inf(1), math.Inf(-1)}
+
+	s := NewDDSketch(c)
+	s.Add(1)
+	for _, v := range invalid {
+		assert.ErrorIs(s.Add(v), ErrInvalidValue)
+		assert.ErrorIs(s.AddBatch([]float64{2, v}), ErrInvalidValue)
+	}
+	assert.Equal(1.0, s.Count())
+	assert.Equal(1.0, s.Sum())
+
+	s = NewDDSketch(c, WithInvalidValuePolicy(IgnoreInvalidValues))
+	s.Add(1)
+	for _, v := range invalid {
+		assert.NoError(s.Add(v))
+		assert.NoError(s.AddBatch([]float64{2, v}))
+	}
+	assert.Equal(4.0, s.Count())
+	assert.Equal(7.0, s.Sum())
+	assert.Equal(2.0, s.Quantile(1))
+
+	o := &testObserver{}
+	s = NewDDSketch(c, WithInvalidValuePolicy(ClampInvalidValues), WithObserver(o))
+	for _, v := range invalid {
+		assert.NoError(s.Add(v))
+	}
+	assert.Equal(2.0, s.Count())
+	assert.Equal(math.MaxFloat64, s.Quantile(1))
+	assert.Equal(-math.MaxFloat64, s.Quantile(0))
+	assert.Equal(c.Key(math.MaxFloat64), s.store.maxKey)
+	assert.Equal(invalid[1:], o.clamped)
+	o.clamped = nil
+	assert.NoError(s.AddBatch(append([]float64{1}, invalid...)))
+	assert.Equal(5.0, s.Count())
+	assert.Equal(invalid[1:], o.clamped)
+}
+
+func TestNegativeAndZeroValues(t *testing.T) {
+	assert := assert.New(t)
+	// Enough bins for the keys from -10 to 10 not to collapse.
+	c := NewConfig(testAlpha, 4096, testMinValue)
+	s := NewDDSketch(c)
+	for i := 0; i < 100; i++ {
+		s.Add(-10)
+		s.Add(0)
+		s.Add(10)
+	}
+	// Ranks 0 to 99 hold -10, 100 to 199 hold 0 and 200 to 299 hold 10.
+	for _, tc := range []struct {
+		q, expected float64
+	}{
+		{0.3, -10},
+		{99.0 / 299, -10},
+		{100.0 / 299, 0},
+		{0.5, 0},
+		{199.0 / 299, 0},
+		{200.0 / 299, 10},
+		{0.9, 10},
+	} {
+		assert.InDelta(tc.expected, s.Quantile(tc.q), testAlpha*10, "quantile %g", tc.q)
+	}
+	assert.Equal(0.0, s.Quantile(0.5))
+	assert.Equal(100.0, s.store.Count(0))
+}
+
+func TestStrictCollapse(t *testing.T) {
+	assert := assert.New(t)
+	c := NewConfig(testAlpha, 100, testMinValue)
+	s := NewDDSketch(c, WithStrictCollapse())
+	for v := 1.0; v < 2.5; v += 0.01 {
+		assert.Nil(s.Add(v))
+	}
+	count := s.Count()
+	err := s.Add(1000)
+	assert.ErrorIs(err, ErrCollapse)
+	assert.ErrorIs(s.AddWithCount(1e-3, 2), ErrCollapse)
+	assert.ErrorIs(s.AddBatch([]float64{2, 1000}), ErrCollapse)
+	assert.Equal(count, s.Count())
+	assert.Equal(float64(0), s.CollapsedCount())
+	assert.Nil(s.AddBatch([]float64{2, 3}))
+
+	_, err = NewDDSketchFromBins(c, []WeightedValue{{Value: 1, Count: 1}, {Value: 1e6, Count: 1}}, WithStrictCollapse())
+	assert.ErrorIs(err, ErrCollapse)
+
+	// Without the option, the lowest values are collapsed.
+	o := NewDDSketch(c)
+	o.Add(1)
+	assert.Nil(o.Add(1000))
+	assert.Equal(float64(1), o.CollapsedCount())
+}
+
+func TestValueRange(t *testing.T) {
+	assert := assert.New(t)
+	c := NewConfig(testAlpha, 100, testMinValue)
+	o := &testObserver{}
+	s := NewDDSketch(c, WithValueRange(1, 2.5), WithStrictCollapse(), WithObserver(o))
+	for v := 1.0; v < 2; v += 0.01 {
+		assert.Nil(s.Add(v))
+	}
+	// The outlier would collapse the store if it was not clamped.
+	assert.Nil(s.Add(1e12))
+	assert.Nil(s.AddWithCount(-5, 2))
+	assert.Nil(s.AddBatch([]float64{1.5, 1e9}))
+	assert.Equal(float64(4), s.OutOfRangeCount())
+	assert.Equal([]float64{1e12, -5, 1e9}, o.clamped)
+	assert.Equal(float64(0), s.CollapsedCount())
+	assert.Equal(float64(2), s.store.Count(c.Key(2.5)))
+	assert.Equal(float64(3), s.store.Count(c.Key(1)))
+	max, _ := s.Max()
+	assert.Equal(2.5, max)
+	min, _ := s.Min()
+	assert.Equal(1.0, min)
+	assert.InEpsilon(2.5, s.Quantile(0.999), testAlpha)
+	assert.Equal(2.5, s.Quantile(1))
+
+	copied := s.MakeCopy()
+	assert.Equal(float64(4), copied.OutOfRangeCount())
+	assert.Nil(copied.Add(2000))
+	assert.Equal(float64(5), copied.OutOfRangeCount())
+	s.Clear()
+	assert.Equal(float64(0), s.OutOfRangeCount())
+
+	o.clamped = nil
+	fromBins, err := NewDDSketchFromBins(c, []WeightedValue{{Value: 0.5, Count: 3}, {Value: 5, Count: 1}}, WithValueRange(1, 10), WithObserver(o))
+	assert.Nil(err)
+	assert.Equal(float64(3), fromBins.OutOfRangeCount())
+	assert.Equal([]float64{0.5}, o.clamped)
+	min, _ = fromBins.Min()
+	assert.Equal(1.0, min)
+}
+
+func TestSummary(t *testing.T) {
+	assert := assert.New(t)
+	c := NewConfig(testAlpha, testMaxBins, testMinValue)
+	s := NewDDSketch(c, WithExactSumOfSquares())
+	_, err := Summary(s, nil)
+	assert.ErrorIs(err, ErrEmptySketch)
+
+	generator := dataset.NewNormal(50, 5)
+	for i := 0; i < 1000; i++ {
+		s.Add(generator.Generate())
+	}
+	r, err := Summary(s, []float64{0.999, 0.25})
+	assert.Nil(err)
+	stdDev, _ := s.StdDev()
+	assert.Equal(SummaryResult{
+		Count:  s.Count(),
+		Sum:    s.Sum(),
+		Min:    s.min,
+		Max:    s.max,
+		Mean:   s.Avg(),
+		StdDev: stdDev,
+		P50:    s.Quantile(0.5),
+		P90:    s.Quantile(0.9),
+		P95:    s.Quantile(0.95),
+		P99:    s.Quantile(0.99),
+		Quantiles: []QuantileValue{
+			{Quantile: 0.999, Value: s.Quantile(0.999)},
+			{Quantile: 0.25, Value: s.Quantile(0.25)},
+		},
+	}, r)
+	_, err = Summary(s, []float64{2})
+	assert.Error(err)
+}
+
+func TestEncodeSummary(t *testing.T) {
+	assert := assert.New(t)
+	c := NewConfig(testAlpha, testMaxBins, testMinValue)
+	s := NewDDSketch(c)
+	generator := dataset.NewNormal(35, 1)
+	for i := 0; i < 1000; i++ {
+		s.Add(generator.Generate())
+	}
+
+	var b []byte
+	s.EncodeSummary(&b)
+	stats, err := DecodeSummary(b)
+	assert.Nil(err)
+	assert.Equal(s.Count(), stats.Count)
+	assert.Equal(s.Sum(), stats.Sum)
+	assert.Equal(s.min, stats.Min)
+	assert.Equal(s.max, stats.Max)
+	assert.Equal(len(summaryQuantiles), len(stats.Quantiles))
+	for i, q := range summaryQuantiles {
+		assert.Equal(q, stats.Quantiles[i].Quantile)
+		assert.Equal(s.Quantile(q), stats.Quantiles[i].Value)
+	}
+
+	_, err = DecodeSummary(b[:len(b)-1])
+	assert.Error(err)
+
+	b = b[:0]
+	NewDDSketch(c).EncodeSummary(&b)
+	stats, err = DecodeSummary(b)
+	assert.Nil(err)
+	assert.Equal(float64(0), stats.Count)
+	assert.Empty(stats.Quantiles)
+}
+
+func TestWeightedValues(t *testing.T) {
+	assert := assert.New(t)
+	c := NewConfig(testAlpha, 4096, testMinValue)
+	s := NewDDSketch(c)
+	assert.Empty(s.WeightedValues())
+
+	for _, v := range []float64{-3, 0, 5, 5, 100} {
+		s.Add(v)
+	}
+	values := s.WeightedValues()
+	assert.Equal(4, len(values))
+	assert.InEpsilon(-3, values[0].Value, testAlpha)
+	assert.Equal(WeightedValue{Value: 0, Count: 1}, values[1])
+	assert.InEpsilon(5, values[2].Value, testAlpha)
+	assert.Equal(float64(2), values[2].Count)
+	assert.InEpsilon(100, values[3].Value, testAlpha)
+	var count float64
+	for i, v := range values {
+		count += v.Count
+		if i > 0 {
+			assert.True(values[i-1].Value < v.Value)
+		}
+	}
+	assert.Equal(s.Count(), count)
+
+	// The order holds across signs and once the store is collapsed.
+	o := NewDDSketch(NewConfig(testAlpha, 100, testMinValue))
+	generator := dataset.NewNormal(0, 100)
+	for i := 0; i < 1000; i++ {
+		o.Add(generator.Generate())
+	}
+	assert.True(o.store.IsCollapsed())
+	values = o.WeightedValues()
+	for i := 1; i < len(values); i++ {
+		assert.Less(values[i-1].Value, values[i].Value)
+	}
+}
+
+func TestForEachBinValue(t *testing.T) {
+	assert := assert.New(t)
+	c := NewConfig(testAlpha, testMaxBins, testMinValue)
+	s := NewDDSketch(c)
+	generator := dataset.NewNormal(100, 20)
+	for i := 0; i < 1000; i++ {
+		s.Add(generator.Generate())
+	}
+	var sum, count float64
+	s.ForEachBinValue(func(value, c float64) bool {
+		sum += value * c
+		count += c
+		return false
+	})
+	assert.Equal(s.Count(), count)
+	assert.InEpsilon(s.Sum(), sum, testAlpha)
+
+	var values []float64
+	s.ForEachBinValue(func(value, c float64) bool {
+		values = append(values, value)
+		return value > 100
+	})
+	assert.True(sort.Float64sAreSorted(values))
+	assert.True(values[len(values)-1] > 100)
+	assert.True(values[len(values)-2] <= 100)
+}
+
+func TestRepresentativeValue(t *testing.T) {
+	assert := assert.New(t)
+	c := NewConfig(testAlpha, 4096, testMinValue)
+	harmonicMean := func(lowerBound, upperBound float64) float64 {
+		return 2 * lowerBound * upperBound / (lowerBound + upperBound)
+	}
+	lowerBound := func(lowerBound, upperBound float64) float64 {
+		return lowerBound
+	}
+	s1 := NewDDSketch(c)
+	s2 := NewDDSketch(c, WithRepresentativeValue(harmonicMean))
+	s3 := NewDDSketch(c, WithRepresentativeValue(lowerBound))
+	generator := dataset.NewNormal(0, 10)
+	for i := 0; i < 1000; i++ {
+		v := generator.Generate()
+		s1.Add(v)
+		s2.Add(v)
+		s3.Add(v)
+	}
+	for _, q := range testQuantiles {
+		assert.InDelta(s1.Quantile(q), s2.Quantile(q), 1e-9)
+		assert.True(s3.Quantile(q) <= s1.Quantile(q))
+	}
+	values1 := s1.WeightedValues()
+	values3 := s3.WeightedValues()
+	for i := range values1 {
+		key := c.Key(values1[i].Value)
+		assert.Equal(c.LowerBound(key), values3[i].Value)
+		assert.True(c.LowerBound(key) <= values1[i].Value && values1[i].Value <= c.UpperBound(key))
+	}
+}
+
+func TestRepresentativeValueSums(t *testing.T) {
+	assert := assert.New(t)
+	c := NewConfig(testAlpha, 4096, testMinValue)
+	funcs := []RepresentativeValueFunc{nil, LowerBoundValue, UpperBoundValue, MidpointValue, GeometricMeanValue}
+	errs := make([]float64, len(funcs))
+	for i, f := range funcs {
+		s := NewDDSketch(c, WithRepresentativeValue(f))
+		// The values are spread evenly on a log scale, over whole bins.
+		lo, hi := c.LowerBound(c.Key(2)), c.LowerBound(c.Key(1e4))
+		for v := lo; v < hi; v *= 1 + 1e-4 {
+			s.Add(v)
+		}
+		var sum float64
+		s.ForEachBinValue(func(value, count float64) bool {
+			key := c.Key(value)
+			assert.True(c.LowerBound(key) <= value && value <= c.UpperBound(key))
+			sum += value * count
+			return false
+		})
+		errs[i] = math.Abs(sum-s.Sum()) / s.Sum()
+	}
+	def, lower, upper, midpoint, geometric := errs[0], errs[1], errs[2], errs[3], errs[4]
+	assert.True(geometric < lower)
+	assert.True(geometric < upper)
+	assert.True(geometric < midpoint)
+	assert.True(geometric < def)
+}
+
+func TestMakeCopy(t *testing.T) {
+	assert := assert.New(t)
+	c := NewConfig(testAlpha, testMaxBins, testMinValue)
+	s := NewDDSketch(c, WithExactSumOfSquares(), WithStrictCollapse(), WithValueRange(-1e3, 1e3))
+	generator := dataset.NewNormal(100, 20)
+	for i := 0; i < 1000; i++ {
+		s.Add(generator.Generate())
+	}
+	s.Add(1e6)
+	copied := s.MakeCopy()
+	assert.Equal(s, copied)
+	assert.NotSame(s.store, copied.store)
+	assert.NotSame(s.config, copied.config)
+
+	quantiles, err := s.Quantiles(testQuantiles)
+	assert.Nil(err)
+	count, sum, min, max := s.count, s.sum, s.min, s.max
+	for i := 0; i < 1000; i++ {
+		copied.Add(generator.Generate() * 3)
+	}
+	copied.Add(-1e6)
+	assert.Nil(copied.Merge(copied.MakeCopy()))
+	assert.NotEqual(count, copied.count)
+	after, err := s.Quantiles(testQuantiles)
+	assert.Nil(err)
+	assert.Equal(quantiles, after)
+	assert.Equal(count, s.count)
+	assert.Equal(sum, s.sum)
+	assert.Equal(min, s.min)
+	assert.Equal(max, s.max)
+	assert.Equal(float64(1), s.OutOfRangeCount())
+	copied.Clear()
+	assert.Equal(count, s.count)
+}
+
+func TestMergeDedup(t *testing.T) {
+	assert := assert.New(t)
+	c := NewConfig(testAlpha, testMaxBins, testMinValue)
+	s1 := NewDDSketch(c)
+	s2 := NewDDSketch(c)
+	generator := dataset.NewExponential(2)
+	for i := 0; i < 100; i++ {
+		s1.Add(generator.Generate())
+		s2.Add(generator.Generate())
+	}
+	assert.Equal(s1.ContentHash(), s1.MakeCopy().ContentHash())
+	assert.NotEqual(s1.ContentHash(), s2.ContentHash())
+
+	d := NewDDSketch(c)
+	d.MergeDedup([]*DDSketch{s1, s2, s1.MakeCopy(), s2})
+	assert.Equal(s1.Count()+s2.Count(), d.Count())
+}
+
+func TestCDF(t *testing.T) {
+	assert := assert.New(t)
+	c := NewConfig(testAlpha, testMaxBins, testMinValue)
+	s := NewDDSketch(c)
+	_, err := s.CDF(1)
+	assert.ErrorIs(err, ErrEmptySketch)
+
+	generator := dataset.NewLognormal(0, 1)
+	values := make([]float64, 10000)
+	for i := range values {
+		values[i] = generator.Generate()
+		s.Add(values[i])
+	}
+	sort.Float64s(values)
+	exactRank := func(x float64) float64 {
+		return float64(sort.Search(len(values), func(i int) bool { return values[i] > x }))
+	}
+	for _, x := range []float64{0.1, 0.5, 1, 2, 5} {
+		rank := s.Rank(x)
+		assert.GreaterOrEqual(rank, exactRank(x/c.gamma))
+		assert.LessOrEqual(rank, exactRank(x*c.gamma))
+		n, err := s.CountBetween(math.Inf(-1), x)
+		assert.Nil(err)
+		assert.InDelta(n, rank, 1e-9)
+		cdf, err := s.CDF(x)
+		assert.NoError(err)
+		assert.Equal(rank/s.Count(), cdf)
+	}
+	assert.Equal(0.0, s.Rank(values[0]/2))
+	assert.Equal(s.Count(), s.Rank(values[len(values)-1]))
+	_, err = s.CDF(math.NaN())
+	assert.ErrorIs(err, ErrInvalidValue)
+}
+
+func TestPercentileOf(t *testing.T) {
+	assert := assert.New(t)
+	c := NewConfig(testAlpha, testMaxBins, testMinValue)
+	s := NewDDSketch(c)
+	_, err := s.PercentileOf(1)
+	assert.ErrorIs(err, ErrEmptySketch)
+	for i := 1; i <= 1000; i++ {
+		s.Add(float64(i))
+	}
+	p, err := s.PercentileOf(870)
+	assert.Nil(err)
+	assert.InDelta(87, p, 100*testAlpha)
+	cdf, _ := s.CDF(870)
+	assert.Equal(cdf*100, p)
+	p, _ = s.PercentileOf(1000)
+	assert.Equal(100.0, p)
+	_, err = s.PercentileOf(math.Inf(1))
+	assert.ErrorIs(err, ErrInvalidValue)
+}
+
+func TestCountBetween(t *testing.T) {
+	assert := assert.New(t)
+	c := NewConfig(testAlpha, testMaxBins, testMinValue)
+	s := NewDDSketch(c)
+	_, err := s.CountBetween(1, 2)
+	assert.ErrorIs(err, ErrEmptySketch)
+
+	// Uniform values from 0.1 to 1000.
+	for i := 1; i <= 10000; i++ {
+		s.Add(float64(i) / 10)
+	}
+	for _, r := range [][2]float64{{100, 500}, {0.5, 1}, {999, 2000}, {250.25, 250.75}} {
+		n, err := s.CountBetween(r[0], r[1])
+		assert.Nil(err)
+		expected := (math.Min(r[1], 1000) - r[0]) * 10
+		assert.InDelta(expected, n, 1+expected*testAlpha, "range %v", r)
+	}
+	n, err := s.CountBetween(-1, 1e6)
+	assert.Nil(err)
+	assert.Equal(s.Count(), n)
+	n, err = s.CountBetween(2000, 3000)
+	assert.Nil(err)
+	assert.Equal(0.0, n)
+	_, err = s.CountBetween(2, 1)
+	assert.Error(err)
+	_, err = s.CountBetween(math.NaN(), 1)
+	assert.Error(err)
+
+	// The bounds in the collapsed range fall in the lowest bin, as in Rank.
+	s = NewDDSketch(NewConfig(testAlpha, 200, testMinValue))
+	for _, v := range []float64{-1e6, -1e5, -1e4, 1, 10, 100, 1000} {
+		s.Add(v)
+	}
+	assert.True(s.store.IsCollapsed())
+	for _, x := range []float64{-5e5, -5e4, -1e4, 5, 500} {
+		n, err := s.CountBetween(s.min, x)
+		assert.Nil(err)
+		assert.InDelta(s.Rank(x), n, 1e-9, "value %g", x)
+	}
+	assert.Greater(s.Rank(-5e4), 0.0)
+}
+
+func TestTrimmedMean(t *testing.T) {
+	assert := assert.New(t)
+	c := NewConfig(testAlpha, testMaxBins, testMinValue)
+	s := NewDDSketch(c)
+	_, err := s.TrimmedMean(0.1, 0.9)
+	assert.ErrorIs(err, ErrEmptySketch)
+
+	for v := 1; v <= 1000; v++ {
+		s.Add(float64(v))
+	}
+	// Outliers that the trimmed mean must exclude.
+	for i := 0; i < 10; i++ {
+		s.Add(1e6)
+	}
+	mean, err := s.TrimmedMean(0, 1)
+	assert.Nil(err)
+	assert.InEpsilon(s.Avg(), mean, testAlpha)
+	mean, err = s.TrimmedMean(0.1, 0.9)
+	assert.Nil(err)
+	assert.InEpsilon(505.0, mean, testAlpha)
+
+	for _, bounds := range [][2]float64{{0.5, 0.5}, {0.9, 0.1}, {-0.1, 0.5}, {0.5, 1.1}, {math.NaN(), 1}} {
+		_, err = s.TrimmedMean(bounds[0], bounds[1])
+		assert.Error(err)
+	}
+}
+
+func TestIQR(t *testing.T) {
+	assert := assert.New(t)
+	c := NewConfig(testAlpha, testMaxBins, testMinValue)
+	s := NewDDSketch(c)
+	_, err := s.IQR()
+	assert.ErrorIs(err, ErrEmptySketch)
+
+	gen := dataset.NewNormal(100, 10)
+	d := dataset.NewDataset()
+	for i := 0; i < 10000; i++ {
+		v := gen.Generate()
+		s.Add(v)
+		d.Add(v)
+	}
+	p25, p75 := d.LowerQuantile(0.25), d.LowerQuantile(0.75)
+	iqr, err := s.IQR()
+	assert.Nil(err)
+	assert.InDelta(p75-p25, iqr, testAlpha*(p25+p75))
+	assert.Equal(s.Quantile(0.75)-s.Quantile(0.25), iqr)
+}
+
+func TestTukeyFences(t *testing.T) {
+	assert := assert.New(t)
+	c := NewConfig(testAlpha, testMaxBins, testMinValue)
+	s := NewDDSketch(c)
+	_, _, err := s.TukeyFences(DefaultTukeyMultiplier)
+	assert.ErrorIs(err, ErrEmptySketch)
+
+	d := dataset.NewDataset()
+	values := []float64{-5000, -1200, 1800, 1e4}
+	for v := 1; v <= 1000; v++ {
+		values = append(values, float64(v))
+	}
+	for _, v := range values {
+		s.Add(v)
+		d.Add(v)
+	}
+	for _, k := range []float64{DefaultTukeyMultiplier, 3} {
+		lower, upper, err := s.TukeyFences(k)
+		assert.Nil(err)
+		iqr, err := s.IQR()
+		assert.Nil(err)
+		assert.InEpsilon(s.Quantile(0.25)-k*iqr, lower, 1e-9)
+		assert.InEpsilon(s.Quantile(0.75)+k*iqr, upper, 1e-9)
+
+		p25, p75 := d.LowerQuantile(0.25), d.LowerQuantile(0.75)
+		naiveLower, naiveUpper := p25-k*(p75-p25), p75+k*(p75-p25)
+		for _, v := range values {
+			naive := v < naiveLower || v > naiveUpper
+			assert.Equal(naive, v < lower || v > upper, "value %g with k %g", v, k)
+		}
+	}
+
+	for _, k := range []float64{-1, math.NaN(), math.Inf(1)} {
+		_, _, err = s.TukeyFences(k)
+		assert.Error(err)
+	}
+}
+
+func TestExactSumAndCount(t *testing.T) {
+	assert := assert.New(t)
+	c := NewConfig(testAlpha, testMaxBins, testMinValue)
+	s1 := NewDDSketch(c)
+	s2 := NewDDSketch(c)
+	generator := dataset.NewExponential(0.1)
+	var sum1, sum2 float64
+	for i := 0; i < 1000; i++ {
+		v := generator.Generate()
+		s1.Add(v)
+		sum1 += v
+		v = generator.Generate()
+		s2.Add(v)
+		sum2 += v
+	}
+	assert.Equal(sum1, s1.Sum())
+	assert.Equal(1000.0, s1.Count())
+	s1.Merge(s2)
+	assert.Equal(sum1+sum2, s1.Sum())
+	assert.Equal(2000.0, s1.Count())
+}
+
+func TestDecay(t *testing.T) {
+	assert := assert.New(t)
+	c := NewConfig(testAlpha, testMaxBins, testMinValue)
+	s := NewDDSketch(c)
+	assert.Error(s.Decay(0, 0))
+	assert.Error(s.Decay(1.5, 0))
+
+	old := dataset.NewNormal(100, 5)
+	for i := 0; i < 1000; i++ {
+		s.Add(old.Generate())
+	}
+	recent := dataset.NewNormal(1000, 50)
+	for interval := 0; interval < 20; interval++ {
+		assert.Nil(s.Decay(0.5, 0.01))
+		for i := 0; i < 1000; i++ {
+			s.Add(recent.Generate())
+		}
+	}
+	// The old values have faded and their bins have been pruned.
+	assert.InEpsilon(1000, s.Quantile(0.5), 0.05)
+	assert.True(s.Quantile(0) > 500)
+	min, _ := s.Min()
+	assert.True(min > 500)
+	assert.Equal(0.0, s.store.Count(c.Key(100)))
+	assert.InEpsilon(1000*2, s.Count(), 0.01)
+	assert.InEpsilon(1000*s.Count(), s.Sum(), 0.05)
+
+	assert.Nil(s.Decay(1e-9, 1))
+	assert.Equal(0.0, s.Count())
+	assert.True(math.IsNaN(s.Quantile(0.5)))
+}
+
+func TestSubtract(t *testing.T) {
+	assert := assert.New(t)
+	c := NewConfig(testAlpha, testMaxBins, testMinValue)
+	previous := NewDDSketch(c)
+	interval := NewDDSketch(c)
+	generator := dataset.NewExponential(0.1)
+	for i := 0; i < 1000; i++ {
+		previous.Add(generator.Generate())
+		interval.Add(100 + generator.Generate())
+	}
+	cumulative := previous.MakeCopy()
+	cumulative.Merge(interval)
+	assert.Nil(cumulative.Subtract(previous))
+	assert.Equal(interval.Count(), cumulative.Count())
+	assert.InEpsilon(interval.Sum(), cumulative.Sum(), 1e-9)
+	assert.True(StoresEqual(interval.store, cumulative.store, 1e-9, false))
+	for _, q := range testQuantiles[1 : len(testQuantiles)-1] {
+		assert.Equal(interval.Quantile(q), cumulative.Quantile(q))
+	}
+
+	// Subtracting more than the sketch holds clamps the counts to zero.
+	s := NewDDSketch(c)
+	s.AddWithCount(10, 2)
+	s.Add(20)
+	o := NewDDSketch(c)
+	o.AddWithCount(10, 5)
+	assert.Nil(s.Subtract(o))
+	assert.Equal(1.0, s.Count())
+	assert.InEpsilon(20, s.Sum(), testAlpha)
+	assert.InEpsilon(20, s.Quantile(0.5), testAlpha)
+	assert.Nil(s.Subtract(s.MakeCopy()))
+	assert.Equal(0.0, s.Count())
+
+	assert.ErrorIs(s.Subtract(NewDDSketch(NewConfig(0.02, testMaxBins, testMinValue))), ErrIncompatibleConfig)
+}
+
+func TestChangeMapping(t *testing.T) {
+	assert := assert.New(t)
+	fine := NewDDSketch(NewConfig(0.001, 8192, testMinValue))
+	c := NewConfig(testAlpha, testMaxBins, testMinValue)
+	generator := dataset.NewLognormal(0, 1)
+	values := make([]float64, 1000)
+	var sum float64
+	for i := range values {
+		values[i] = generator.Generate()
+		fine.Add(values[i])
+		sum += values[i]
+	}
+	sort.Float64s(values)
+	// The error of the result is bounded by the accuracy of both
+	// configurations.
+	tolerance := testAlpha + 0.001 + 1e-9
+
+	coarse := fine.ChangeMapping(c, 1000)
+	assert.Equal(c, coarse.config)
+	assert.Equal(fine.Count(), coarse.Count())
+	assert.InEpsilon(sum*1000, coarse.Sum(), 1e-9)
+	assert.InEpsilon(values[0]*1000, coarse.min, 1e-9)
+	assert.InEpsilon(values[len(values)-1]*1000, coarse.max, 1e-9)
+	for _, q := range testQuantiles {
+		expected := values[int(q*float64(len(values)-1))] * 1000
+		assert.InEpsilon(expected, coarse.Quantile(q), tolerance)
+	}
+
+	negated := fine.ChangeMapping(c, -1)
+	assert.Equal(-fine.max, negated.min)
+	assert.Equal(-fine.min, negated.max)
+	for _, q := range testQuantiles {
+		expected := -values[len(values)-1-int(q*float64(len(values)-1))]
+		assert.InEpsilon(expected, negated.Quantile(q), tolerance)
+	}
+}
+
+func TestMergeAll(t *testing.T) {
+	assert := assert.New(t)
+	c := NewConfig(testAlpha, testMaxBins, testMinValue)
+	srcs := make([]*DDSketch, 10)
+	expected := NewDDSketch(c)
+	for i := range srcs {
+		srcs[i] = NewDDSketch(c)
+		if i%3 == 0 {
+			// Leave some of the sources empty.
+			continue
+		}
+		generator := dataset.NewNormal(float64(10*i*i), float64(i*i))
+		for j := 0; j < 100; j++ {
+			srcs[i].Add(generator.Generate())
+		}
+		expected.Merge(srcs[i])
+	}
+	dst := NewDDSketch(c)
+	assert.Nil(MergeAll(dst))
+	assert.Equal(0.0, dst.Count())
+	assert.Nil(MergeAll(dst, srcs...))
+	assert.Equal(expected.Count(), dst.Count())
+	assert.Equal(expected.Sum(), dst.Sum())
+	assert.Equal(expected.min, dst.min)
+	assert.Equal(expected.max, dst.max)
+	assert.True(StoresEqual(expected.store, dst.store, 0, false))
+
+	// Sources below the range that dst can hold are collapsed.
+	collapsing := NewDDSketch(NewConfig(testAlpha, 10, testMinValue))
+	assert.Nil(MergeAll(collapsing, srcs...))
+	assert.Equal(expected.Count(), collapsing.Count())
+	assert.True(collapsing.store.IsCollapsed())
+	assert.Equal(expected.Quantile(0.999), collapsing.Quantile(0.999))
+
+	incompatible := NewDDSketch(NewConfig(0.02, testMaxBins, testMinValue))
+	incompatible.Add(1)
+	assert.ErrorIs(MergeAll(dst, srcs[1], incompatible), ErrIncompatibleConfig)
+	assert.Equal(expected.Count(), dst.Count())
+}
+
+func newBenchmarkShards() []*DDSketch {
+	c := NewDefaultConfig()
+	shards := make([]*DDSketch, 1000)
+	for i := range shards {
+		shards[i] = NewDDSketch(c)
+		generator := dataset.NewLognormal(float64(i%10), 1)
+		for j := 0; j < 100; j++ {
+			shards[i].Add(generator.Generate())
+		}
+	}
+	return shards
+}
+
+func BenchmarkMergeLoop(b *testing.B) {
+	shards := newBenchmarkShards()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		dst := NewDDSketch(NewDefaultConfig())
+		for _, shard := range shards {
+			dst.Merge(shard)
+		}
+	}
+}
+
+func BenchmarkMergeAll(b *testing.B) {
+	shards := newBenchmarkShards()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		MergeAll(NewDDSketch(NewDefaultConfig()), shards...)
+	}
+}
+
+func TestAggregateCollapsedFraction(t *testing.T) {
+	assert := assert.New(t)
+	c := NewConfig(testAlpha, 200, testMinValue)
+	assert.Equal(0.0, NewDDSketch(c).AggregateCollapsedFraction())
+	var srcs []*DDSketch
+	var count, collapsed float64
+	for i := 0; i < 10; i++ {
+		s := NewDDSketch(c)
+		// One host in three has values spread over too many bins.
+		spread := 1.5
+		if i%3 == 0 {
+			spread = 100
+		}
+		for v := 1.0; v < spread; v *= 1.001 {
+			s.Add(v)
+		}
+		count += s.Count()
+		collapsed += s.CollapsedCount()
+		srcs = append(srcs, s)
+	}
+	assert.True(collapsed > 0)
+
+	merged := NewDDSketch(c)
+	for _, s := range srcs {
+		assert.Nil(merged.Merge(s))
+	}
+	all := NewDDSketch(c)
+	assert.Nil(MergeAll(all, srcs...))
+	weighted := NewDDSketch(c)
+	for _, s := range srcs {
+		assert.Nil(weighted.MergeWithWeight(s, 1))
+	}
+	// The merges also collapse the values of the other hosts that are below
+	// the range of the spread ones.
+	var below float64
+	for _, s := range srcs {
+		below += s.CollapsedCount()
+		s.store.ForEach(func(key int, c float64) bool {
+			if key < all.store.minKey {
+				below += c
+			}
+			return key >= all.store.minKey
+		})
+	}
+	assert.True(below > collapsed)
+	for _, s := range []*DDSketch{merged, all, weighted} {
+		assert.Equal(count, s.Count())
+		assert.InDelta(below/count, s.AggregateCollapsedFraction(), 1e-12)
+	}
+}
+
+func TestMergeIntoNarrower(t *testing.T) {
+	assert := assert.New(t)
+	wide := NewDDSketch(NewConfig(testAlpha, 4096, testMinValue))
+	for v := 1.0; v < 1e12; v *= 1.01 {
+		wide.Add(v)
+	}
+	narrow := NewConfig(testAlpha, 200, testMinValue)
+	inside := NewDDSketch(narrow)
+	inside.Add(1e6)
+	for _, dst := range []*DDSketch{NewDDSketch(narrow), inside} {
+		expected := dst.MakeCopy()
+		assert.Nil(MergeAll(expected, wide))
+		assert.Nil(dst.Merge(wide))
+		assert.LessOrEqual(len(dst.store.bins), 200)
+		assert.True(dst.store.IsCollapsed())
+		assert.True(StoresEqual(expected.store, dst.store, 0, false))
+		assert.Equal(expected.store.CollapsedCount(), dst.store.CollapsedCount())
+	}
+}
+
+func TestMergeIncompatible(t *testing.T) {
+	assert := assert.New(t)
+	c := NewConfig(testAlpha, testMaxBins, testMinValue)
+	s1 := NewDDSketch(c)
+	s2 := NewDDSketch(NewConfig(0.02, testMaxBins, testMinValue))
+	s1.Add(1)
+	s2.Add(2)
+	assert.ErrorIs(s1.Merge(s2), ErrIncompatibleConfig)
+	assert.Equal(1.0, s1.Count())
+	assert.ErrorIs(s1.MergeDedup([]*DDSketch{s2}), ErrIncompatibleConfig)
+
+	assert.Nil(s1.Merge(s2.ChangeMapping(c, 1)))
+	assert.Equal(2.0, s1.Count())
+	// Only the mapping matters, not the maximum number of bins.
+	assert.Nil(s1.Merge(NewDDSketch(NewConfig(testAlpha, 2*testMaxBins, testMinValue))))
+}
+
+func TestMergeWithWeight(t *testing.T) {
+	assert := assert.New(t)
+	c := NewConfig(testAlpha, testMaxBins, testMinValue)
+	s := NewDDSketch(c, WithExactSumOfSquares())
+	generator := dataset.NewExponential(0.5)
+	for i := 0; i < 1000; i++ {
+		s.Add(generator.Generate())
+	}
+	count := s.Count()
+
+	weighted := NewDDSketch(c, WithExactSumOfSquares())
+	assert.Nil(weighted.MergeWithWeight(s, 1))
+	assert.Nil(weighted.MergeWithWeight(s, 2))
+	merged := NewDDSketch(c, WithExactSumOfSquares())
+	for i := 0; i < 3; i++ {
+		assert.Nil(merged.Merge(s))
+	}
+	assert.Equal(count, s.Count())
+	assert.Equal(merged.Count(), weighted.Count())
+	assert.InEpsilon(merged.Sum(), weighted.Sum(), 1e-9)
+	assert.Equal(merged.min, weighted.min)
+	assert.Equal(merged.max, weighted.max)
+	assert.True(weighted.HasExactStats())
+	for _, q := range testQuantiles {
+		assert.Equal(merged.Quantile(q), weighted.Quantile(q))
+	}
+
+	assert.Nil(weighted.MergeWithWeight(s, 0.5))
+	assert.Equal(3.5*count, weighted.Count())
+	assert.Error(weighted.MergeWithWeight(s, 0))
+	assert.Error(weighted.MergeWithWeight(s, math.Inf(1)))
+	assert.ErrorIs(weighted.MergeWithWeight(NewDDSketch(NewConfig(0.02, testMaxBins, testMinValue)), 1), ErrIncompatibleConfig)
+	assert.Equal(3.5*count, weighted.Count())
+}
+
+func TestClear(t *testing.T) {
+	assert := assert.New(t)
+	c := NewConfig(testAlpha, testMaxBins, testMinValue)
+	s := NewDDSketch(c, WithExactSumOfSquares())
+	generator := dataset.NewExponential(0.5)
+	for i := 0; i < 1000; i++ {
+		s.Add(generator.Generate())
+	}
+	capacity := cap(s.store.bins)
+	s.Clear()
+	assert.Equal(0.0, s.Count())
+	assert.Equal(0.0, s.Sum())
+	assert.True(math.IsNaN(s.Quantile(0.5)))
+	_, err := s.Min()
+	assert.ErrorIs(err, ErrEmptySketch)
+	assert.Equal(capacity, cap(s.store.bins))
+
+	fresh := NewDDSketch(c, WithExactSumOfSquares())
+	for i := 0; i < 1000; i++ {
+		v := generator.Generate()
+		s.Add(v)
+		fresh.Add(v)
+	}
+	assert.Equal(fresh.Count(), s.Count())
+	assert.Equal(fresh.Sum(), s.Sum())
+	assert.Equal(fresh.sumSquares, s.sumSquares)
+	assert.Equal(fresh.min, s.min)
+	assert.Equal(fresh.max, s.max)
+	assert.Equal(fresh.ContentHash(), s.ContentHash())
+	for _, q := range testQuantiles {
+		assert.Equal(fresh.Quantile(q), s.Quantile(q))
+	}
+}
+
+func TestMinMax(t *testing.T) {
+	assert := assert.New(t)
+	c := NewConfig(testAlpha, testMaxBins, testMinValue)
+	s1 := NewDDSketch(c)
+	_, err := s1.Min()
+	assert.ErrorIs(err, ErrEmptySketch)
+	_, err = s1.Max()
+	assert.ErrorIs(err, ErrEmptySketch)
+
+	s2 := NewDDSketch(c)
+	for _, v := range []float64{3.3, -1.7, 12.25} {
+		s1.Add(v)
+	}
+	s2.Add(-8.125)
+	s1.Merge(s2)
+	min, err := s1.Min()
+	assert.Nil(err)
+	assert.Equal(-8.125, min)
+	max, err := s1.Max()
+	assert.Nil(err)
+	assert.Equal(12.25, max)
+
+	b, err := json.Marshal(s1)
+	assert.Nil(err)
+	decoded := &DDSketch{}
+	assert.Nil(json.Unmarshal(b, decoded))
+	min, _ = decoded.Min()
+	max, _ = decoded.Max()
+	assert.Equal(-8.125, min)
+	assert.Equal(12.25, max)
+}
+
+func TestVariance(t *testing.T) {
+	assert := assert.New(t)
+	c := NewConfig(testAlpha, testMaxBins, testMinValue)
+	exact1 := NewDDSketch(c, WithExactSumOfSquares())
+	exact2 := NewDDSketch(c, WithExactSumOfSquares())
+	estimated := NewDDSketch(c)
+	assert.True(exact1.HasExactStats())
+	assert.False(estimated.HasExactStats())
+	_, err := exact1.Variance()
+	assert.ErrorIs(err, ErrEmptySketch)
+
+	generator := dataset.NewNormal(100, 10)
+	values := make([]float64, 2000)
+	for i := range values {
+		values[i] = generator.Generate()
+		estimated.Add(values[i])
+	}
+	exact1.AddBatch(values[:1000])
+	for _, v := range values[1000:] {
+		exact2.Add(v)
+	}
+	exact1.Merge(exact2)
+
+	var mean, variance float64
+	for _, v := range values {
+		mean += v
+	}
+	mean /= float64(len(values))
+	for _, v := range values {
+		variance += (v - mean) * (v - mean)
+	}
+	variance /= float64(len(values))
+
+	v, err := exact1.Variance()
+	assert.Nil(err)
+	assert.InEpsilon(variance, v, 1e-9)
+	stdDev, err := exact1.StdDev()
+	assert.Nil(err)
+	assert.InEpsilon(math.Sqrt(variance), stdDev, 1e-9)
+	v, err = estimated.Variance()
+	assert.Nil(err)
+	assert.InEpsilon(variance, v, 0.1)
+
+	b, err := json.Marshal(exact1)
+	assert.Nil(err)
+	decoded := &DDSketch{}
+	assert.Nil(json.Unmarshal(b, decoded))
+	assert.True(decoded.HasExactStats())
+	assert.Equal(exact1.sumSquares, decoded.sumSquares)
+
+	// Merging a sketch without exact stats loses the exactness.
+	exact1.Merge(estimated)
+	assert.False(exact1.HasExactStats())
+}
+
+func TestIsReliable(t *testing.T) {
+	assert := assert.New(t)
+	c := NewConfig(testAlpha, testMaxBins, testMinValue)
+	s := NewDDSketch(c)
+	assert.False(s.IsReliable(0, 0.5))
+	for i := 0; i < 100; i++ {
+		s.Add(42)
+	}
+	assert.False(s.IsReliable(10, 0.5))
+	for i := 0; i < 100; i++ {
+		s.Add(float64(i + 1))
+	}
+	assert.True(s.IsReliable(10, 0.5))
+	assert.True(s.IsReliable(200, 0.99))
+	assert.False(s.IsReliable(201, 0.99))
+	assert.False(s.IsReliable(10, 1.5))
+	assert.False(s.IsReliable(1, math.NaN()))
+}
+
+func TestRollupSet(t *testing.T) {
+	assert := assert.New(t)
+	c := NewConfig(testAlpha, testMaxBins, testMinValue)
+	r := NewRollupSet()
+	r.Set("hourly", NewDDSketch(c))
+	r.Set("daily", NewDDSketch(c))
+	expected := NewDDSketch(c)
+	generator := dataset.NewNormal(35, 1)
+	for i := 0; i < 10; i++ {
+		src := NewDDSketch(c)
+		for j := 0; j < 100; j++ {
+			src.Add(generator.Generate())
+		}
+		assert.Nil(r.AddTo([]string{"hourly", "daily", "hourly"}, src))
+		expected.Merge(src)
+	}
+	for _, name := range []string{"hourly", "daily"} {
+		s := r.Get(name)
+		assert.Equal(expected.Count(), s.Count())
+		assert.Equal(expected.min, s.min)
+		assert.Equal(expected.max, s.max)
+		for _, q := range testQuantiles {
+			assert.Equal(expected.Quantile(q), s.Quantile(q))
+		}
+	}
+
+	assert.Error(r.AddTo([]string{"weekly"}, expected))
+	r.Set("coarse", NewDDSketch(NewConfig(0.05, testMaxBins, testMinValue)))
+	assert.ErrorIs(r.AddTo([]string{"hourly", "coarse"}, expected), ErrIncompatibleConfig)
+	assert.Equal(float64(1000), r.Get("hourly").Count())
+
+	// The values collapsed in the source stay counted as collapsed.
+	small := NewConfig(testAlpha, 10, testMinValue)
+	r.Set("small", NewDDSketch(small))
+	r.Set("large", NewDDSketch(NewConfig(testAlpha, 1000, testMinValue)))
+	src := NewDDSketch(small)
+	for _, v := range []float64{1, 2, 3, 1000} {
+		src.Add(v)
+	}
+	assert.Equal(3.0, src.store.CollapsedCount())
+	assert.Nil(r.AddTo([]string{"small", "large"}, src))
+	assert.Nil(r.AddTo([]string{"small", "large"}, src))
+	assert.Equal(6.0, r.Get("small").store.CollapsedCount())
+	assert.Equal(6.0, r.Get("large").store.CollapsedCount())
+}
+
+func TestSplitAt(t *testing.T) {
+	assert := assert.New(t)
+	c := NewConfig(testAlpha, testMaxBins, testMinValue)
+	s := NewDDSketch(c)
+	dBelow := dataset.NewDataset()
+	dAbove := dataset.NewDataset()
+	for i := 1; i <= 1000; i++ {
+		v := float64(i)
+		s.Add(v)
+		if v < 500 {
+			dBelow.Add(v)
+		} else {
+			dAbove.Add(v)
+		}
+	}
+
+	below, above, err := s.SplitAt(500)
+	assert.Nil(err)
+	assert.Equal(s.config, below.config)
+	assert.Equal(s.config, above.config)
+	assert.Equal(s.Count(), below.Count()+above.Count())
+	assert.InEpsilon(s.Sum(), below.Sum()+above.Sum(), 1e-9)
+	assert.Equal(float64(1), below.min)
+	assert.Equal(float64(1000), above.max)
+	// The bin holding 500 is assigned as a whole to one side.
+	assert.InDelta(dBelow.Count, below.Count(), 5)
+	assert.InEpsilon(dBelow.Sum(), below.Sum(), 2*testAlpha)
+	assert.InEpsilon(dAbove.Sum(), above.Sum(), 2*testAlpha)
+	assert.InEpsilon(dBelow.Quantile(0.5), below.Quantile(0.5), 2*testAlpha)
+	assert.InEpsilon(dAbove.Quantile(0.5), above.Quantile(0.5), 2*testAlpha)
+
+	below, above, err = s.SplitAt(1e6)
+	assert.Nil(err)
+	assert.Equal(s.Count(), below.Count())
+	assert.Equal(float64(0), above.Count())
+	assert.Equal(s.Sum(), below.Sum())
+	assert.Equal(s.max, below.max)
+
+	_, _, err = s.SplitAt(math.NaN())
+	assert.Error(err)
+
+	// The collapsed values stay with the lowest bin.
+	s = NewDDSketch(NewConfig(testAlpha, 10, testMinValue))
+	for _, v := range []float64{1, 2, 3, 1000} {
+		s.Add(v)
+	}
+	assert.Equal(3.0, s.store.CollapsedCount())
+	below, above, _ = s.SplitAt(1000)
+	assert.Equal(3.0, below.store.CollapsedCount())
+	assert.Equal(0.0, above.store.CollapsedCount())
+	below, above, _ = s.SplitAt(0.5)
+	assert.Equal(0.0, below.store.CollapsedCount())
+	assert.Equal(3.0, above.store.CollapsedCount())
+}
+
+type testObserver struct {
+	collapsed float64
+	clamped   []float64
+	grown     int
+}
+
+func (o *testObserver) OnCollapse(count float64) { o.collapsed += count }
+func (o *testObserver) OnClamp(value float64)    { o.clamped = append(o.clamped, value) }
+func (o *testObserver) OnGrow(newCap int)        { o.grown++ }
+
+func TestObserver(t *testing.T) {
+	assert := assert.New(t)
+	c := NewConfig(testAlpha, testMaxBins, testMinValue)
+	o := &testObserver{}
+	s := NewDDSketch(c, WithObserver(o))
+	s.Add(1)
+	assert.Equal(0, o.grown)
+	s.Add(2)
+	assert.Equal(float64(0), o.collapsed)
+	assert.True(o.grown > 0)
+
+	// Values that are too far apart to fit in maxNumBins bins get collapsed.
+	s.Add(1e-12)
+	assert.Equal([]float64{1e-12}, o.clamped)
+	assert.Equal(float64(1), o.collapsed)
+	s.Add(1e9)
+	assert.Equal(float64(2), o.collapsed)
+}
+
+func TestExpectedMinValue(t *testing.T) {
+	c := NewConfig(testAlpha, testMaxBins, testMinValue)
+	o := &testObserver{}
+	s := NewDDSketch(c, WithObserver(o), WithExpectedMinValue(1e9))
+	d := dataset.NewDataset()
+	generator := dataset.NewExponential(1)
+	for i := 0; i < 1000; i++ {
+		v := 1e9 * (1 + generator.Generate()/10)
+		s.Add(v)
+		d.Add(v)
+	}
+	AssertSketchesAccurate(t, d, s, c)
+	assert.Equal(t, 0, o.grown)
+}
+
+func TestJSON(t *testing.T) {
+	assert := assert.New(t)
+	c := NewConfig(testAlpha, testMaxBins, testMinValue)
+	s := NewDDSketch(c)
+	generator := dataset.NewLognormal(0, 2)
+	for i := 0; i < 1000; i++ {
+		s.Add(generator.Generate())
+	}
+
+	for _, sketch := range []*DDSketch{s, NewDDSketch(c)} {
+		b, err := json.Marshal(sketch)
+		assert.Nil(err)
+		decoded := &DDSketch{}
+		assert.Nil(json.Unmarshal(b, decoded))
+		assert.Equal(*sketch.config, *decoded.config)
+		assert.Equal(sketch.count, decoded.count)
+		assert.Equal(sketch.sum, decoded.sum)
+		assert.Equal(sketch.min, decoded.min)
+		assert.Equal(sketch.max, decoded.max)
+		assert.True(StoresEqual(sketch.store, decoded.store, 0, false))
+		assert.Equal(sketch.ContentHash(), decoded.ContentHash())
+		rows, _ := sketch.QuantileTable(testQuantiles, false)
+		decodedRows, _ := decoded.QuantileTable(testQuantiles, false)
+		assert.Equal(rows, decodedRows)
+	}
+
+	// The sum overflows once the clamped infinities are added up.
+	inf := NewDDSketch(c, WithInvalidValuePolicy(ClampInvalidValues), WithExactSumOfSquares())
+	assert.Nil(inf.Add(math.Inf(1)))
+	assert.Nil(inf.Add(math.Inf(1)))
+	assert.Nil(inf.Add(-1))
+	b, err := json.Marshal(inf)
+	assert.Nil(err)
+	decoded := &DDSketch{}
+	assert.Nil(json.Unmarshal(b, decoded))
+	assert.Equal(math.Inf(1), decoded.sum)
+	assert.Equal(math.Inf(1), decoded.sumSquares)
+	assert.Equal(inf.min, decoded.min)
+	assert.Equal(inf.max, decoded.max)
+	var buf bytes.Buffer
+	assert.Nil(gob.NewEncoder(&buf).Encode(inf))
+	decoded = &DDSketch{}
+	assert.Nil(gob.NewDecoder(&buf).Decode(decoded))
+	assert.Equal(math.Inf(1), decoded.sum)
+	b = bytes.Replace(b, []byte(`"+Inf"`), []byte(`"Inf"`), 1)
+	assert.Error(json.Unmarshal(b, &DDSketch{}))
+
+	b, err = json.Marshal(s)
+	assert.Nil(err)
+	b = bytes.Replace(b, []byte(`"logarithmic"`), []byte(`"cubic"`), 1)
+	assert.EqualError(json.Unmarshal(b, &DDSketch{}), `unknown mapping "cubic"`)
+}
+
+func TestJSONInvalid(t *testing.T) {
+	assert := assert.New(t)
+	c := NewConfig(testAlpha, testMaxBins, testMinValue)
+	config := `{"mapping":"logarithmic","gamma":1.02,"gammaLn":0.0198,"offset":0,"minValue":1e-9`
+	for _, b := range []string{
+		config + `}`,
+		config + `,"maxNumBins":0}`,
+		config + `,"maxNumBins":-1}`,
+	} {
+		assert.Error(json.Unmarshal([]byte(b), &Config{}), b)
+	}
+	for _, b := range []string{
+		`{"bins":[{"key":1,"count":1}]}`,
+		`{"maxNumBins":0,"bins":[]}`,
+		`{"maxNumBins":-5,"bins":[{"key":1,"count":1}]}`,
+		`{"maxNumBins":10,"bins":[{"key":1,"count":-1}]}`,
+		`{"maxNumBins":10,"bins":[{"key":1,"count":1e400}]}`,
+		`{"maxNumBins":10,"bins":[],"collapsed":-1}`,
+	} {
+		assert.Error(json.Unmarshal([]byte(b), &Store{}), b)
+	}
+	// JSON cannot encode NaN and infinite counts, which are rejected too.
+	for _, count := range []float64{math.NaN(), math.Inf(1), math.Inf(-1), -1} {
+		assert.False(isValidCount(count))
+	}
+	assert.Error(json.Unmarshal([]byte(`{"maxNumBins":0,"bins":[]}`), &IntStore{}))
+
+	s := NewDDSketch(c)
+	s.Add(1)
+	b, err := json.Marshal(s)
+	assert.Nil(err)
+	for _, r := range [][2]string{
+		{`"count":1,`, `"count":-1,`},
+		{`"maxNumBins":1024,`, `"maxNumBins":0,`},
+	} {
+		assert.Error(json.Unmarshal(bytes.Replace(b, []byte(r[0]), []byte(r[1]), 1), &DDSketch{}), r[1])
+	}
+	decoded := &DDSketch{}
+	assert.Nil(json.Unmarshal(b, decoded))
+	assert.Nil(decoded.Add(2))
+	assert.Equal(2.0, decoded.Count())
+}
+
+func TestStoreJSONWiderThanMaxNumBins(t *testing.T) {
+	assert := assert.New(t)
+	wide := NewStore(5000)
+	for key := 0; key < 5000; key++ {
+		wide.Add(key)
+	}
+	b, err := json.Marshal(wide)
+	assert.Nil(err)
+	b = bytes.Replace(b, []byte(`"maxNumBins":5000`), []byte(`"maxNumBins":1000`), 1)
+	var s Store
+	assert.Nil(json.Unmarshal(b, &s))
+	assert.Equal(float64(5000), s.count)
+	assert.True(cap(s.bins) <= 1000)
+	assert.Equal(4999, s.maxKey)
+	assert.Equal(float64(4000), s.CollapsedCount())
+	assert.Equal(float64(4001), s.Count(s.minKey))
+}
+
+func TestJSONDecodeLimit(t *testing.T) {
+	assert := assert.New(t)
+	// A payload cannot raise the number of bins the decoder allocates.
+	hostile := `{"maxNumBins":1073741824,"bins":[{"key":0,"count":1},{"key":536870912,"count":1}]}`
+	assert.Error(json.Unmarshal([]byte(hostile), &Store{}))
+	wide := NewStore(2000)
+	for key := 0; key < 2000; key++ {
+		wide.Add(key)
+	}
+	b, err := json.Marshal(wide)
+	assert.Nil(err)
+	assert.Error(json.Unmarshal(b, NewStore(1000)))
+	s := NewStore(2000)
+	assert.Nil(json.Unmarshal(b, s))
+	assert.Equal(float64(2000), s.count)
+
+	sketch := NewDDSketch(NewConfig(testAlpha, 2000, testMinValue))
+	sketch.Add(1)
+	b, err = json.Marshal(sketch)
+	assert.Nil(err)
+	assert.Error(json.Unmarshal(b, NewDDSketch(NewConfig(testAlpha, 1000, testMinValue))))
+	decoded := NewDDSketch(NewConfig(testAlpha, 2000, testMinValue))
+	assert.Nil(json.Unmarshal(b, decoded))
+	assert.Equal(1.0, decoded.Count())
+	hostile = string(bytes.Replace(b, []byte(`"maxNumBins":2000`), []byte(`"maxNumBins":1073741824`), -1))
+	assert.Error(json.Unmarshal([]byte(hostile), &DDSketch{}))
+	assert.Error(json.Unmarshal(bytes.Replace(b, []byte(`"store":{`), []byte(`"store":null,"x":{`), 1), &DDSketch{}))
+}
+
+func TestGob(t *testing.T) {
+	assert := assert.New(t)
+	c := NewConfig(testAlpha, testMaxBins, testMinValue)
+	s := NewDDSketch(c, WithExactSumOfSquares())
+	generator := dataset.NewLognormal(0, 2)
+	for i := 0; i < 1000; i++ {
+		s.Add(generator.Generate())
+	}
+
+	// Sketches are sent as fields of the messages of gob-based channels.
+	type message struct {
+		Name   string
+		Sketch *DDSketch
+		Config *Config
+		Store  *Store
+	}
+	var buf bytes.Buffer
+	assert.Nil(gob.NewEncoder(&buf).Encode(message{Name: "latency", Sketch: s, Config: c, Store: s.store}))
+	var decoded message
+	assert.Nil(gob.NewDecoder(&buf).Decode(&decoded))
+	assert.Equal("latency", decoded.Name)
+	assert.Equal(*c, *decoded.Config)
+	assert.True(StoresEqual(s.store, decoded.Store, 0, false))
+	assert.Equal(s.ContentHash(), decoded.Sketch.ContentHash())
+	assert.Equal(s.count, decoded.Sketch.count)
+	assert.Equal(s.sum, decoded.Sketch.sum)
+	assert.True(decoded.Sketch.HasExactStats())
+	for _, q := range testQuantiles {
+		assert.Equal(s.Quantile(q), decoded.Sketch.Quantile(q))
+	}
+}
+
+func TestWriteHistogramCSV(t *testing.T) {
+	assert := assert.New(t)
+	c := NewConfig(testAlpha, testMaxBins, testMinValue)
+	s := NewDDSketch(c)
+	var buf bytes.Buffer
+	assert.Nil(WriteHistogramCSV(&buf, s))
+	assert.Equal("key,lower_bound,upper_bound,count\n", buf.String())
+
+	s.Add(1)
+	s.Add(100)
+	s.Add(100)
+	buf.Reset()
+	assert.Nil(WriteHistogramCSV(&buf, s))
+	records, err := csv.NewReader(&buf).ReadAll()
+	assert.Nil(err)
+	assert.Equal(3, len(records))
+	for i, v := range []float64{1, 100} {
+		record := records[i+1]
+		assert.Equal(strconv.Itoa(c.Key(v)), record[0])
+		lower, _ := strconv.ParseFloat(record[1], 64)
+		upper, _ := strconv.ParseFloat(record[2], 64)
+		assert.True(lower < v && v <= upper)
+	}
+	assert.Equal("1", records[1][3])
+	assert.Equal("2", records[2][3])
+}
+
+func TestPool(t *testing.T) {
+	assert := assert.New(t)
+	c := NewConfig(testAlpha, testMaxBins, testMinValue)
+	p := NewPool(c, WithExactSumOfSquares())
+	s := p.Get()
+	assert.True(s.HasExactStats())
+	for i := 0; i < 100; i++ {
+		s.Add(float64(i))
+	}
+	p.Put(s)
+	s = p.Get()
+	assert.Equal(0.0, s.Count())
+	assert.True(math.IsNaN(s.Quantile(0.5)))
+
+	// Merging a sketch that does not track the sum of the squares only makes s
+	// inexact until it is recycled.
+	o := NewDDSketch(c)
+	o.Add(1)
+	assert.Nil(s.Merge(o))
+	assert.False(s.HasExactStats())
+	p.Put(s)
+	s = p.Get()
+	assert.True(s.HasExactStats())
+	for _, v := range []float64{1, 2, 3, 4} {
+		s.Add(v)
+	}
+	variance, err := s.Variance()
+	assert.Nil(err)
+	assert.InEpsilon(1.25, variance, 1e-9)
+}
+
+func benchmarkSketchChurn(b *testing.B, get func() *DDSketch, put func(*DDSketch)) {
+	generator := dataset.NewExponential(0.1)
+	values := make([]float64, 1000)
+	for i := range values {
+		values[i] = generator.Generate()
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s := get()
+		for _, v := range values {
+			s.Add(v)
+		}
+		put(s)
+	}
+}
+
+func BenchmarkSketchChurn(b *testing.B) {
+	c := NewDefaultConfig()
+	benchmarkSketchChurn(b, func() *DDSketch { return NewDDSketch(c) }, func(*DDSketch) {})
+}
+
+func BenchmarkSketchChurnPool(b *testing.B) {
+	p := NewPool(NewDefaultConfig())
+	benchmarkSketchChurn(b, p.Get, p.Put)
+}
+
+func TestConcurrentDDSketch(t *testing.T) {
+	assert := assert.New(t)
+	c := NewConfig(testAlpha, testMaxBins, testMinValue)
+	s := NewConcurrentDDSketch(c)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				s.Add(float64(j + 1))
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				s.Quantile(0.5)
+				s.Count()
+				snapshot := s.Snapshot()
+				if snapshot.Count() > 0 {
+					qs, err := snapshot.Quantiles([]float64{0, 1})
+					assert.Nil(err)
+					assert.Equal([]float64{snapshot.min, snapshot.max}, qs)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(8000.0, s.Count())
+	assert.InEpsilon(500, s.Quantile(0.5), testAlpha)
+
+	snapshot := s.Snapshot()
+	s.Add(1e6)
+	assert.Equal(8000.0, snapshot.Count())
+	assert.Equal(1000.0, snapshot.max)
+	qs, err := s.Quantiles([]float64{1})
+	assert.Nil(err)
+	assert.Equal([]float64{1e6}, qs)
+
+	assert.Nil(s.Merge(s))
+	assert.Equal(16002.0, s.Count())
+	dst := NewDDSketch(c)
+	assert.Nil(s.MergeInto(dst))
+	assert.Equal(16002.0, dst.Count())
+}
+
+func TestShardedDDSketch(t *testing.T) {
+	assert := assert.New(t)
+	c := NewConfig(testAlpha, testMaxBins, testMinValue)
+	s := NewShardedDDSketch(c)
+	expected := NewDDSketch(c)
+	for j := 0; j < 1000; j++ {
+		expected.AddWithCount(float64(j+1), 8)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				s.Add(float64(j + 1))
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				s.Quantile(0.5)
+			}
+		}()
+	}
+	wg.Wait()
+
+	snapshot, err := s.Snapshot()
+	assert.Nil(err)
+	assert.Equal(expected.Count(), snapshot.Count())
+	assert.Equal(expected.Sum(), snapshot.Sum())
+	assert.True(StoresEqual(expected.store, snapshot.store, 0, false))
+	for _, q := range testQuantiles {
+		assert.Equal(expected.Quantile(q), s.Quantile(q))
+	}
+	// Taking a snapshot leaves the shards unmodified.
+	var count float64
+	for i := range s.shards {
+		count += s.shards[i].sketch.Count()
+	}
+	assert.Equal(expected.Count(), count)
+	assert.Equal(expected.Count(), s.Count())
+	assert.Equal(expected.Sum(), s.Sum())
+
+	// Queries do not notify the observer of the shards.
+	o := &testObserver{}
+	s = NewShardedDDSketch(c, WithObserver(o))
+	for j := 0; j < 1000; j++ {
+		s.Add(float64(j + 1))
+	}
+	grown := o.grown
+	for j := 0; j < 10; j++ {
+		s.Quantile(0.5)
+	}
+	assert.Equal(grown, o.grown)
+	assert.Equal(0.0, o.collapsed)
+}
+
+func TestExactThenSketch(t *testing.T) {
+	assert := assert.New(t)
+	c := NewConfig(testAlpha, testMaxBins, testMinValue)
+	gen := dataset.NewLognormal(0, 2)
+	for _, n := range []int{500, 2000} {
+		s := NewExactThenSketch(c, 1000)
+		expected := NewDDSketch(c)
+		d := dataset.NewDataset()
+		for i := 0; i < n; i++ {
+			v := gen.Generate()
+			assert.Nil(s.Add(v))
+			expected.Add(v)
+			d.Add(v)
+		}
+		assert.Equal(float64(n), s.Count())
+		assert.Equal(n <= 1000, s.IsExact())
+		qs, err := s.Quantiles(testQuantiles)
+		assert.Nil(err)
+		for i, q := range testQuantiles {
+			assert.Equal(s.Quantile(q), qs[i])
+			if s.IsExact() {
+				assert.Equal(d.LowerQuantile(q), qs[i])
+			} else {
+				assert.Equal(expected.Quantile(q), qs[i])
+			}
+		}
+		snapshot, err := s.Snapshot()
+		assert.Nil(err)
+		assert.True(StoresEqual(expected.store, snapshot.store, 0, false))
+	}
+
+	s := NewExactThenSketch(c, 10)
+	assert.True(math.IsNaN(s.Quantile(0.5)))
+	_, err := s.Quantiles([]float64{0.5})
+	assert.ErrorIs(err, ErrEmptySketch)
+	assert.NotNil(s.Add(math.NaN()))
+	assert.Equal(0.0, s.Count())
+
+	// A value that would not fit in the sketch along with the others is
+	// rejected right away, rather than when the values are replayed.
+	s = NewExactThenSketch(NewConfig(testAlpha, 10, testMinValue), 3, WithStrictCollapse())
+	assert.Nil(s.Add(1))
+	assert.Nil(s.Add(1.05))
+	assert.ErrorIs(s.Add(1e10), ErrCollapse)
+	assert.Equal(2.0, s.Count())
+	assert.Nil(s.Add(1.02))
+	assert.Nil(s.Add(1.08))
+	assert.False(s.IsExact())
+	assert.Equal(4.0, s.Count())
+	assert.ErrorIs(s.Add(1e10), ErrCollapse)
+	assert.Equal(4.0, s.Count())
+
+	// The values recorded exactly are clamped to the range, like the ones
+	// added to the sketch.
+	o := &testObserver{}
+	s = NewExactThenSketch(c, 10, WithValueRange(0, 10), WithObserver(o))
+	for _, v := range []float64{1, 2, 100, 3} {
+		assert.Nil(s.Add(v))
+	}
+	assert.Equal(10.0, s.Quantile(1))
+	assert.Equal([]float64{100}, o.clamped)
+	snapshot, err := s.Snapshot()
+	assert.Nil(err)
+	assert.Equal(1.0, snapshot.OutOfRangeCount())
+	for v := 4.0; v < 12; v++ {
+		assert.Nil(s.Add(v))
+	}
+	assert.False(s.IsExact())
+	assert.Equal(10.0, s.Quantile(1))
+	snapshot, err = s.Snapshot()
+	assert.Nil(err)
+	assert.Equal(2.0, snapshot.OutOfRangeCount())
+}
+
+func benchmarkConcurrentAdd(b *testing.B, add func(float64) error) {
+	b.SetParallelism(max(1, 16/runtime.GOMAXPROCS(0)))
+	b.RunParallel(func(pb *testing.PB) {
+		v := 1.0
+		for pb.Next() {
+			add(v)
+			v += 0.5
+		}
+	})
+}
+
+func BenchmarkConcurrentDDSketchAdd(b *testing.B) {
+	benchmarkConcurrentAdd(b, NewConcurrentDDSketch(NewDefaultConfig()).Add)
+}
+
+func BenchmarkShardedDDSketchAdd(b *testing.B) {
+	benchmarkConcurrentAdd(b, NewShardedDDSketch(NewDefaultConfig()).Add)
+}
+
+func TestToPrometheusBuckets(t *testing.T) {
+	assert := assert.New(t)
+	c := NewConfig(testAlpha, testMaxBins, testMinValue)
+	s := NewDDSketch(c)
+	upperBounds := []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5}
+	buckets, total, err := ToPrometheusBuckets(s, upperBounds)
+	assert.Nil(err)
+	assert.Equal(make([]float64, len(upperBounds)), buckets)
+	assert.Equal(0.0, total)
+
+	for _, v := range []float64{0.01, 0.07, 0.07, 0.3, 0.9, 0.9, 0.9, 4} {
+		s.Add(v)
+	}
+	buckets, total, err = ToPrometheusBuckets(s, upperBounds)
+	assert.Nil(err)
+	assert.Equal([]float64{1, 3, 3, 4, 7, 7}, buckets)
+	assert.Equal(8.0, total)
+
+	_, _, err = ToPrometheusBuckets(s, []float64{1, 0.5})
+	assert.Error(err)
+	_, _, err = ToPrometheusBuckets(s, []float64{math.NaN()})
+	assert.Error(err)
+}
+
+// nativeHistogramBuckets encodes the counts of the buckets at indexes as the
+// spans and deltas of a native histogram.
+func nativeHistogramBuckets(counts map[int]int64) ([]PrometheusBucketSpan, []int64) {
+	indexes := make([]int, 0, len(counts))
+	for i := range counts {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+	var spans []PrometheusBucketSpan
+	var deltas []int64
+	var previous int64
+	end := 0
+	for n, i := range indexes {
+		if n == 0 || i > end {
+			spans = append(spans, PrometheusBucketSpan{Offset: int32(i - end)})
+			if n == 0 {
+				spans[0].Offset = int32(i)
+			}
+		}
+		spans[len(spans)-1].Length++
+		deltas = append(deltas, counts[i]-previous)
+		previous = counts[i]
+		end = i + 1
+	}
+	return spans, deltas
+}
+
+func TestFromPrometheusNativeHistogram(t *testing.T) {
+	assert := assert.New(t)
+	const schema = 3
+	base := math.Exp2(math.Exp2(-schema))
+	generator := dataset.NewNormal(0, 100)
+	values := make([]float64, 1000)
+	positive, negative := map[int]int64{}, map[int]int64{}
+	var sum float64
+	for i := range values {
+		values[i] = generator.Generate()
+		index := int(math.Ceil(math.Log(math.Abs(values[i])) / math.Log(base)))
+		if values[i] > 0 {
+			positive[index]++
+		} else {
+			negative[index]++
+		}
+		sum += values[i]
+	}
+	h := PrometheusNativeHistogram{Schema: schema, Sum: sum, ZeroCount: 3}
+	h.PositiveSpans, h.PositiveDeltas = nativeHistogramBuckets(positive)
+	h.NegativeSpans, h.NegativeDeltas = nativeHistogramBuckets(negative)
+
+	s, err := FromPrometheusNativeHistogram(h, 4096)
+	assert.Nil(err)
+	assert.InEpsilon(base, s.config.gamma, 1e-12)
+	expected := NewDDSketch(s.config)
+	for _, v := range values {
+		expected.Add(v)
+	}
+	expected.AddWithCount(0, 3)
+	assert.Equal(expected.Count(), s.Count())
+	assert.Equal(sum, s.Sum())
+	assert.True(StoresEqual(expected.store, s.store, 0, false))
+	assert.True(s.min <= expected.min && s.max >= expected.max)
+	// The estimates of s are clamped to its min and max, which are the bounds of
+	// the extreme buckets: clamping them to the actual min and max instead gives
+	// the estimates of expected, and they are within the relative accuracy of
+	// the schema of them.
+	alpha := (base - 1) / (base + 1)
+	for _, q := range testQuantiles[1 : len(testQuantiles)-1] {
+		assert.Equal(expected.Quantile(q), math.Max(expected.min, math.Min(expected.max, s.Quantile(q))))
+		assert.InEpsilon(expected.Quantile(q), s.Quantile(q), alpha)
+	}
+	assert.Equal(s.min, s.Quantile(0))
+	assert.Equal(s.max, s.Quantile(1))
+
+	h.PositiveDeltas = h.PositiveDeltas[1:]
+	_, err = FromPrometheusNativeHistogram(h, 4096)
+	assert.Error(err)
+	_, err = FromPrometheusNativeHistogram(PrometheusNativeHistogram{Schema: 9}, 4096)
+	assert.Error(err)
+	s, err = FromPrometheusNativeHistogram(PrometheusNativeHistogram{}, 4096)
+	assert.Nil(err)
+	assert.Equal(0.0, s.Count())
+}
+
+func TestToOTLPExponentialHistogram(t *testing.T) {
+	assert := assert.New(t)
+	generator := dataset.NewNormal(0, 100)
+	values := make([]float64, 1000)
+	for i := range values {
+		values[i] = generator.Generate()
+	}
+	for scale := int32(-2); scale <= 8; scale++ {
+		gammaLn := math.Ln2 * math.Exp2(-float64(scale))
+		// Enough bins for the finest scales not to collapse.
+		c := newConfigWithGamma(math.Exp(gammaLn), gammaLn, 1<<16, testMinValue)
+		derived, exact := otlpScale(c)
+		assert.Equal(scale, derived)
+		assert.True(exact)
+
+		s := NewDDSketch(c)
+		s.AddBatch(values)
+		s.AddWithCount(0, 3)
+		h := ToOTLPExponentialHistogram(s)
+		assert.Equal(scale, h.Scale)
+		assert.Equal(uint64(1003), h.Count)
+		assert.Equal(uint64(3), h.ZeroCount)
+		assert.Equal(s.Sum(), h.Sum)
+		assert.Equal(s.min, *h.Min)
+		assert.Equal(s.max, *h.Max)
+		// Each value is counted in the bucket that holds it.
+		base := math.Exp2(math.Exp2(-float64(scale)))
+		positive, negative := map[int]uint64{}, map[int]uint64{}
+		for _, v := range values {
+			index := int(math.Ceil(math.Log(math.Abs(v))/math.Log(base))) - 1
+			if v > 0 {
+				positive[index]++
+			} else {
+				negative[index]++
+			}
+		}
+		for _, side := range []struct {
+			expected map[int]uint64
+			buckets  OTLPBuckets
+		}{{positive, h.Positive}, {negative, h.Negative}} {
+			actual := map[int]uint64{}
+			for i, n := range side.buckets.BucketCounts {
+				if n > 0 {
+					actual[int(side.buckets.Offset)+i] = n
+				}
+			}
+			assert.Equal(side.expected, actual)
+		}
+	}
+
+	// Other gammas are converted to the next coarser scale.
+	c := NewConfig(testAlpha, 4096, testMinValue)
+	scale, exact := otlpScale(c)
+	assert.Equal(int32(5), scale)
+	assert.False(exact)
+	s := NewDDSketch(c)
+	s.AddBatch(values)
+	h := ToOTLPExponentialHistogram(s)
+	assert.Equal(int32(5), h.Scale)
+	assert.Equal(uint64(1000), h.Count)
+	var n uint64
+	for _, buckets := range []OTLPBuckets{h.Positive, h.Negative} {
+		for _, count := range buckets.BucketCounts {
+			n += count
+		}
+	}
+	assert.Equal(uint64(1000), n)
+
+	h = ToOTLPExponentialHistogram(NewDDSketch(c))
+	assert.Equal(uint64(0), h.Count)
+	assert.Nil(h.Min)
+	assert.Empty(h.Positive.BucketCounts)
+}
+
+func TestFromOTLPExponentialHistogram(t *testing.T) {
+	assert := assert.New(t)
+	// Buckets of base 2: (1, 2] holds 3 values, (2, 4] 5, (8, 16] 2 and
+	// [-2, -1) 4, along with 1 zero.
+	lo, hi := -1.5, 12.0
+	h := OTLPExponentialHistogram{
+		Scale:         0,
+		Count:         15,
+		Sum:           30,
+		Min:           &lo,
+		Max:           &hi,
+		ZeroCount:     1,
+		ZeroThreshold: 1e-9,
+		Positive:      OTLPBuckets{Offset: 0, BucketCounts: []uint64{3, 5, 0, 2}},
+		Negative:      OTLPBuckets{Offset: 0, BucketCounts: []uint64{4}},
+	}
+	s, err := FromOTLPExponentialHistogram(h, 4096)
+	assert.Nil(err)
+	assert.InEpsilon(2, s.config.gamma, 1e-12)
+	assert.Equal(15.0, s.Count())
+	assert.Equal(30.0, s.Sum())
+	assert.Equal(-1.5, s.min)
+	assert.Equal(12.0, s.max)
+	for _, b := range []struct {
+		value float64
+		count float64
+	}{{-1.5, 4}, {0, 1}, {1.5, 3}, {3, 5}, {12, 2}} {
+		assert.Equal(b.count, s.store.Count(s.config.Key(b.value)))
+	}
+	// The ranks of the quantiles land in the expected buckets.
+	for _, row := range []struct {
+		q, lower, upper float64
+	}{{0.2, -2, -1}, {0.3, 0, 0}, {0.4, 1, 2}, {0.7, 2, 4}, {0.95, 8, 16}} {
+		v := s.Quantile(row.q)
+		assert.True(row.lower <= v && v <= row.upper, "q=%g: %g", row.q, v)
+	}
+	assert.Equal(h, ToOTLPExponentialHistogram(s))
+
+	// Round-trip through an exported sketch, estimating the min and max.
+	generator := dataset.NewLognormal(0, 2)
+	gammaLn := math.Ln2 / 16
+	c := newConfigWithGamma(math.Exp(gammaLn), gammaLn, 4096, testMinValue)
+	expected := NewDDSketch(c)
+	for i := 0; i < 1000; i++ {
+		expected.Add(generator.Generate())
+	}
+	exported := ToOTLPExponentialHistogram(expected)
+	exported.Min, exported.Max = nil, nil
+	s, err = FromOTLPExponentialHistogram(exported, 4096)
+	assert.Nil(err)
+	assert.True(StoresEqual(expected.store, s.store, 0, false))
+	assert.True(s.min <= expected.min && s.max >= expected.max)
+	for _, q := range []float64{0.1, 0.25, 0.5, 0.75, 0.9} {
+		assert.Equal(expected.Quantile(q), s.Quantile(q))
+	}
+
+	_, err = FromOTLPExponentialHistogram(OTLPExponentialHistogram{Scale: 21}, 4096)
+	assert.Error(err)
+	s, err = FromOTLPExponentialHistogram(OTLPExponentialHistogram{}, 4096)
+	assert.Nil(err)
+	assert.Equal(0.0, s.Count())
+}
+
+func TestCircllhist(t *testing.T) {
+	assert := assert.New(t)
+	// Enough bins for the keys from -35.5 to 205 not to collapse.
+	c := NewConfig(testAlpha, 4096, testMinValue)
+	// H[-3.5e+01]=2, H[0]=1, H[1.2e+00]=5, H[2.0e+02]=1
+	bins := []CircllhistBin{
+		{Value: -35, Exp: 1, Count: 2},
+		{Value: 0, Exp: 0, Count: 1},
+		{Value: 12, Exp: 0, Count: 5},
+		{Value: 20, Exp: 2, Count: 1},
+	}
+	s, err := FromCircllhist(c, bins)
+	assert.Nil(err)
+	assert.Equal(9.0, s.Count())
+	assert.Equal(-35.5, s.min)
+	assert.Equal(205.0, s.max)
+	assert.InEpsilon(1.25, s.Quantile(0.5), testAlpha)
+	assert.Equal(0.0, s.Quantile(0.3))
+	// The representative values of the sketch are far enough from the bounds
+	// of the circllhist bins for them to round-trip.
+	assert.Equal(bins, ToCircllhist(s))
+
+	for _, value := range []int8{5, -5, 100, 127, -100, -128} {
+		_, err = FromCircllhist(c, []CircllhistBin{{Value: value, Exp: 0, Count: 1}})
+		assert.Error(err, "value %d", value)
+	}
+
+	// The exponents of the values from 1e128 do not fit in an int8.
+	s = NewDDSketch(c)
+	for _, v := range []float64{5.55e127, 1e130, 1e131} {
+		assert.Nil(s.Add(v))
+	}
+	assert.Equal([]CircllhistBin{
+		{Value: 55, Exp: 127, Count: 1},
+		{Value: 99, Exp: 127, Count: 2},
+	}, ToCircllhist(s))
+	s = NewDDSketch(c)
+	assert.Nil(s.Add(-1e300))
+	assert.Equal([]CircllhistBin{{Value: -99, Exp: 127, Count: 1}}, ToCircllhist(s))
+}
+
+func TestHDRHistogram(t *testing.T) {
+	assert := assert.New(t)
+	c := NewConfig(testAlpha, testMaxBins, testMinValue)
+	s, err := FromHDRHistogram(c, []int64{1, 5, 1000, 1000000}, []int64{3, 0, 4, 1})
+	assert.Nil(err)
+	assert.Equal(8.0, s.Count())
+	assert.Equal(1.0, s.min)
+	assert.Equal(1000000.0, s.max)
+	assert.InEpsilon(1000, s.Quantile(0.5), testAlpha)
+
+	// With 2 significant figures, the buckets from 256 on are power-of-two
+	// multiples wide, and all the values of a bin of the sketch fall into one.
+	values, counts, err := ToHDRHistogram(s, 2)
+	assert.Nil(err)
+	assert.Equal([]int64{3, 4, 1}, counts)
+	assert.Equal(int64(1), values[0])
+	assert.InEpsilon(1000, values[1], 2*testAlpha)
+	assert.InEpsilon(1000000, values[2], 2*testAlpha)
+
+	// The linear buckets below 256 have a unit width.
+	s, _ = FromHDRHistogram(c, []int64{10, 11, 100}, []int64{1, 1, 2})
+	values, counts, err = ToHDRHistogram(s, 2)
+	assert.Nil(err)
+	assert.Equal([]int64{10, 11, 100}, values)
+	assert.Equal([]int64{1, 1, 2}, counts)
+
+	_, err = FromHDRHistogram(c, []int64{1}, nil)
+	assert.Error(err)
+	_, _, err = ToHDRHistogram(s, 0)
+	assert.Error(err)
+	s.Add(-1)
+	_, _, err = ToHDRHistogram(s, 2)
+	assert.Error(err)
+	s = NewDDSketch(c)
+	s.Add(1)
+	s.Add(1e300)
+	_, _, err = ToHDRHistogram(s, 2)
+	assert.Error(err)
+}
@@ -0,0 +1,173 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2018 Datadog, Inc.
+
+package ddsketch
+
+import (
+	"fmt"
+	"math"
+	"slices"
+)
+
+// ExactThenSketch records the values it is given as they are until it holds
+// more than a threshold of them, and answers exact quantiles in that regime.
+// Past the threshold, the values are replayed into a DDSketch, which adds and
+// answers the following ones with its relative accuracy. Small populations,
+// for which the error of the sketch is the most visible, thus get exact
+// quantiles while the memory stays bounded for large ones.
+type ExactThenSketch struct {
+	sketch    *DDSketch
+	threshold int
+	// values holds the values added to s while it is exact. It is nil once they
+	// have been replayed into sketch. minKey and maxKey are the range of their
+	// keys, and outOfRange the number of them that were clamped to the range
+	// of the sketch.
+	values         []float64
+	minKey, maxKey int
+	outOfRange     float64
+	sorted         bool
+	exact          bool
+}
+
+// NewExactThenSketch allocates a new ExactThenSketch that is exact for up to
+// threshold values, and then is a DDSketch configured like NewDDSketch.
+func NewExactThenSketch(c *Config, threshold int, opts ...Option) *ExactThenSketch {
+	return &ExactThenSketch{
+		sketch:    NewDDSketch(c, opts...),
+		threshold: threshold,
+		exact:     true,
+	}
+}
+
+// Add a new value. The options of the sketch apply to the values recorded
+// exactly too: they are checked with its InvalidValuePolicy, clamped to the
+// range set by WithValueRange, and rejected by WithStrictCollapse if they would
+// not fit in the sketch along with the other values.
+func (s *ExactThenSketch) Add(v float64) error {
+	if !s.exact {
+		return s.sketch.Add(v)
+	}
+	v, ok, err := s.sketch.checkValue(v)
+	if !ok {
+		return err
+	}
+	v, clamped := s.sketch.clampValue(v)
+	key := s.sketch.config.Key(v)
+	minKey, maxKey := key, key
+	if len(s.values) > 0 {
+		minKey, maxKey = min(s.minKey, key), max(s.maxKey, key)
+	}
+	if s.sketch.strictCollapse {
+		if err := s.sketch.checkCollapse(minKey, maxKey); err != nil {
+			return err
+		}
+	}
+	prevMinKey, prevMaxKey := s.minKey, s.maxKey
+	s.values = append(s.values, v)
+	s.minKey, s.maxKey = minKey, maxKey
+	if clamped {
+		s.outOfRange++
+	}
+	s.sorted = false
+	if len(s.values) > s.threshold {
+		if err := s.flush(); err != nil {
+			// Leave s as it was before v.
+			s.values = s.values[:len(s.values)-1]
+			s.minKey, s.maxKey = prevMinKey, prevMaxKey
+			if clamped {
+				s.outOfRange--
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// flush replays the values recorded exactly into the sketch, which answers the
+// queries from then on.
+func (s *ExactThenSketch) flush() error {
+	if err := replay(s.sketch, s.values, s.outOfRange); err != nil {
+		return fmt.Errorf("replaying %d exact values: %w", len(s.values), err)
+	}
+	s.values = nil
+	s.outOfRange = 0
+	s.exact = false
+	return nil
+}
+
+// replay adds the values recorded exactly to sketch, outOfRange of them having
+// been clamped to its range.
+func replay(sketch *DDSketch, values []float64, outOfRange float64) error {
+	if err := sketch.AddBatch(values); err != nil {
+		return err
+	}
+	sketch.outOfRange += outOfRange
+	return nil
+}
+
+// IsExact returns whether s still holds the values it was given, in which case
+// its quantiles are exact.
+func (s *ExactThenSketch) IsExact() bool {
+	return s.exact
+}
+
+func (s *ExactThenSketch) Count() float64 {
+	if s.exact {
+		return float64(len(s.values))
+	}
+	return s.sketch.Count()
+}
+
+// Quantile returns the element at q, with the same rank as DDSketch.Quantile,
+// if s is exact, and the estimate of the sketch otherwise.
+func (s *ExactThenSketch) Quantile(q float64) float64 {
+	if !s.exact {
+		return s.sketch.Quantile(q)
+	}
+	if q < 0 || q > 1 || len(s.values) == 0 {
+		return math.NaN()
+	}
+	return s.sortedValues()[int(q*float64(len(s.values)-1))]
+}
+
+// Quantiles returns the elements, or their estimates, at each of qs, in the
+// order of qs.
+func (s *ExactThenSketch) Quantiles(qs []float64) ([]float64, error) {
+	if !s.exact {
+		return s.sketch.Quantiles(qs)
+	}
+	if len(s.values) == 0 {
+		return nil, ErrEmptySketch
+	}
+	values := make([]float64, len(qs))
+	for i, q := range qs {
+		if !(q >= 0 && q <= 1) {
+			return nil, fmt.Errorf("quantile %g is not in [0, 1]", q)
+		}
+		values[i] = s.Quantile(q)
+	}
+	return values, nil
+}
+
+func (s *ExactThenSketch) sortedValues() []float64 {
+	if !s.sorted {
+		slices.Sort(s.values)
+		s.sorted = true
+	}
+	return s.values
+}
+
+// Snapshot returns a DDSketch that holds the values added to s, to be merged
+// with or serialized like other sketches. It is a copy, which later additions
+// to s leave unmodified.
+func (s *ExactThenSketch) Snapshot() (*DDSketch, error) {
+	snapshot := s.sketch.MakeCopy()
+	if s.exact {
+		if err := replay(snapshot, s.values, s.outOfRange); err != nil {
+			return nil, err
+		}
+	}
+	return snapshot, nil
+}
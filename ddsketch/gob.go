@@ -0,0 +1,38 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2018 Datadog, Inc.
+
+package ddsketch
+
+import "encoding/json"
+
+// The gob encodings reuse the JSON ones as their payload, so that configs,
+// stores and sketches can be sent through encoding/gob although their fields
+// are unexported.
+
+func (c *Config) GobEncode() ([]byte, error) {
+	return json.Marshal(c)
+}
+
+func (c *Config) GobDecode(b []byte) error {
+	return json.Unmarshal(b, c)
+}
+
+func (s *Store) GobEncode() ([]byte, error) {
+	return json.Marshal(s)
+}
+
+func (s *Store) GobDecode(b []byte) error {
+	return json.Unmarshal(b, s)
+}
+
+// GobEncode encodes the sketch like MarshalJSON. Options the sketch was
+// constructed with are not encoded.
+func (s *DDSketch) GobEncode() ([]byte, error) {
+	return json.Marshal(s)
+}
+
+func (s *DDSketch) GobDecode(b []byte) error {
+	return json.Unmarshal(b, s)
+}
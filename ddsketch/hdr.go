@@ -0,0 +1,83 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2018 Datadog, Inc.
+
+package ddsketch
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+)
+
+// FromHDRHistogram builds a sketch configured with c from the recorded values of
+// an HdrHistogram and their counts, as listed by its iterators. Each value is
+// added with its count, so the result is bounded by the coarser of the
+// precision of the HdrHistogram and the relative accuracy of c.
+func FromHDRHistogram(c *Config, values, counts []int64) (*DDSketch, error) {
+	if len(values) != len(counts) {
+		return nil, fmt.Errorf("got %d values but %d counts", len(values), len(counts))
+	}
+	bins := make([]WeightedValue, 0, len(values))
+	for i, v := range values {
+		if counts[i] < 0 {
+			return nil, fmt.Errorf("value %d has a negative count", v)
+		}
+		if counts[i] > 0 {
+			bins = append(bins, WeightedValue{Value: float64(v), Count: float64(counts[i])})
+		}
+	}
+	return NewDDSketchFromBins(c, bins)
+}
+
+// ToHDRHistogram re-bins the sketch into the buckets of an HdrHistogram with
+// significantFigures significant decimal digits, from 1 to 5. It returns the
+// lowest equivalent value of each nonempty bucket, in ascending order, with its
+// count rounded to an integer. The representative value of each bin of the
+// sketch is rounded to an integer and added to the bucket that holds it, so the
+// result is bounded by the coarser of the relative accuracy of the sketch and
+// the precision of the buckets. HdrHistograms cannot hold negative values, nor
+// values from 2^63 on.
+func ToHDRHistogram(s *DDSketch, significantFigures int) (values, counts []int64, err error) {
+	if significantFigures < 1 || significantFigures > 5 {
+		return nil, nil, fmt.Errorf("significant figures %d is not in [1, 5]", significantFigures)
+	}
+	if s.count > 0 && s.min < 0 {
+		return nil, nil, fmt.Errorf("cannot convert negative values to an HdrHistogram")
+	}
+	// The number of bits of the values that HdrHistogram resolves, as it
+	// computes its subBucketHalfCountMagnitude.
+	largest := 2 * int64(math.Pow10(significantFigures))
+	magnitude := int(math.Ceil(math.Log2(float64(largest)))) - 1
+	var buckets []WeightedValue
+	s.ForEachBinValue(func(value, count float64) bool {
+		if math.Round(value) >= math.MaxInt64 {
+			err = fmt.Errorf("value %g does not fit in an HdrHistogram", value)
+			return true
+		}
+		v := int64(math.Round(value))
+		unit := int64(1)
+		if shift := bits.Len64(uint64(v)) - 1 - magnitude; shift > 0 {
+			unit <<= shift
+		}
+		lowest := float64(v &^ (unit - 1))
+		// The bins are walked in ascending order, and so are the buckets.
+		if n := len(buckets); n > 0 && buckets[n-1].Value == lowest {
+			buckets[n-1].Count += count
+		} else {
+			buckets = append(buckets, WeightedValue{Value: lowest, Count: count})
+		}
+		return false
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, b := range buckets {
+		if n := int64(math.Round(b.Count)); n > 0 {
+			values = append(values, int64(b.Value))
+			counts = append(counts, n)
+		}
+	}
+	return values, counts, nil
+}
@@ -0,0 +1,569 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2018 Datadog, Inc.
+
+package ddsketch
+
+import (
+	"bytes"
+	"cmp"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"slices"
+	"sort"
+	"unsafe"
+)
+
+// IntStore is a Store with integer counts. Its bins take 4 bytes rather than 8,
+// and the counts do not drift as they would with floats, which suits the use
+// cases that only record whole observations, such as keeping many stores in
+// memory. It has the semantics of Store: the bins cover at most maxNumBins
+// contiguous keys, grow the same way, and the lowest keys are folded into the
+// lowest bin when the store outgrows them. The count of a bin saturates at
+// math.MaxUint32: the observations beyond that are dropped.
+//
+// It has the methods of Store, with integer counts. A DDSketch is always backed
+// by a Store: to be queried by a sketch, an IntStore is converted with ToStore.
+type IntStore struct {
+	bins       []uint32
+	count      uint64
+	minKey     int
+	maxKey     int
+	maxNumBins int
+	// collapsed is the number of observations that have been folded into the
+	// lowest bin while their keys were lower.
+	collapsed uint64
+}
+
+// NewIntStore returns an empty store of at most maxNumBins bins, or of one bin
+// if maxNumBins is not positive.
+func NewIntStore(maxNumBins int) *IntStore {
+	return &IntStore{
+		bins:       make([]uint32, initialNumBins),
+		maxNumBins: max(maxNumBins, 1),
+	}
+}
+
+func (s *IntStore) Length() int {
+	return len(s.bins)
+}
+
+func (s *IntStore) Add(key int) {
+	s.AddWithCount(key, 1)
+}
+
+// AddWithCount adds count observations to the bin at key.
+func (s *IntStore) AddWithCount(key int, count uint32) {
+	if count == 0 {
+		return
+	}
+	if key < s.minKey || key > s.maxKey || s.count == 0 {
+		s.GrowTo(key, key)
+	}
+	idx := key - s.minKey
+	added := s.addToBin(max(idx, 0), uint64(count))
+	if idx < 0 {
+		s.collapsed += added
+	}
+}
+
+// AddBatch adds one observation to the bin of each of keys. The bins are grown
+// once to cover all the keys before being filled.
+func (s *IntStore) AddBatch(keys []int) {
+	if len(keys) == 0 {
+		return
+	}
+	lo, hi := keys[0], keys[0]
+	for _, key := range keys[1:] {
+		lo = min(lo, key)
+		hi = max(hi, key)
+	}
+	s.GrowTo(lo, hi)
+	for _, key := range keys {
+		idx := key - s.minKey
+		if s.addToBin(max(idx, 0), 1) > 0 && idx < 0 {
+			s.collapsed++
+		}
+	}
+}
+
+// addToBin adds up to n observations to the bin at idx, as many as its count
+// can hold, and returns how many it added.
+func (s *IntStore) addToBin(idx int, n uint64) uint64 {
+	n = min64(n, math.MaxUint32-uint64(s.bins[idx]))
+	s.bins[idx] += uint32(n)
+	s.count += n
+	return n
+}
+
+// GrowTo grows the bins at once to cover the keys from minKey to maxKey, or as
+// many of the highest of them as maxNumBins allows, like Store.GrowTo.
+func (s *IntStore) GrowTo(minKey, maxKey int) {
+	if s.count == 0 && (maxKey < s.minKey || maxKey > s.maxKey || s.maxKey-s.minKey+1 != len(s.bins)) {
+		s.maxKey = maxKey
+		s.minKey = maxKey - len(s.bins) + 1
+	}
+	if minKey >= s.minKey && maxKey <= s.maxKey {
+		return
+	}
+	lo, hi := s.minKey, max(maxKey, s.maxKey)
+	if maxKey > s.maxKey && maxKey-lo >= s.maxNumBins {
+		lo = maxKey - s.maxNumBins + 1
+	}
+	if minKey < lo && hi-lo+1 < s.maxNumBins {
+		if hi-minKey >= s.maxNumBins {
+			lo = hi - s.maxNumBins + 1
+		} else {
+			for lo > minKey {
+				lo -= growLeftBy
+			}
+			lo = max(lo, hi-s.maxNumBins+1)
+		}
+	}
+	s.resize(lo, hi)
+}
+
+// resize moves the bins to cover the keys from lo to hi, folding the bins below
+// lo into the lowest one, like Store.resize.
+func (s *IntStore) resize(lo, hi int) {
+	var n uint64
+	for key := s.minKey; key < lo && key <= s.maxKey; key++ {
+		n += uint64(s.bins[key-s.minKey])
+	}
+	length := hi - lo + 1
+	if lo >= s.minKey && length <= cap(s.bins) {
+		bins := s.bins[:length]
+		var copied int
+		if lo <= s.maxKey {
+			copied = copy(bins, s.bins[lo-s.minKey:])
+		}
+		clear(bins[copied:])
+		s.bins = bins
+	} else {
+		bins := make([]uint32, length)
+		if lo <= s.maxKey {
+			copy(bins[max(s.minKey-lo, 0):], s.bins[max(lo-s.minKey, 0):])
+		}
+		s.bins = bins
+	}
+	s.minKey, s.maxKey = lo, hi
+	if n > 0 {
+		s.count -= n
+		s.addToBin(0, n)
+		// The observations that were already collapsed are in the folded bins.
+		s.collapsed = max64(s.collapsed, n)
+	}
+}
+
+// TotalCount returns the number of observations in the store.
+func (s *IntStore) TotalCount() uint64 {
+	return s.count
+}
+
+// Count returns the count of the bin at key, or 0 if key is out of the bins of
+// the store, like Store.Count.
+func (s *IntStore) Count(key int) uint32 {
+	if s.count == 0 || key < s.minKey || key > s.maxKey {
+		return 0
+	}
+	return s.bins[key-s.minKey]
+}
+
+// CumulativeCount returns the total count of the bins whose key is lower than
+// or equal to key.
+func (s *IntStore) CumulativeCount(key int) uint64 {
+	if s.count == 0 || key < s.minKey {
+		return 0
+	}
+	if key >= s.maxKey {
+		return s.count
+	}
+	var n uint64
+	for _, c := range s.bins[:key-s.minKey+1] {
+		n += uint64(c)
+	}
+	return n
+}
+
+// NumBins returns the number of nonzero bins of the store.
+func (s *IntStore) NumBins() int {
+	n := 0
+	for _, b := range s.bins {
+		if b != 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// CollapsedCount returns the number of observations that have been folded into
+// the lowest bin because the store reached its maximum number of bins.
+func (s *IntStore) CollapsedCount() uint64 {
+	return s.collapsed
+}
+
+func (s *IntStore) IsCollapsed() bool {
+	return s.collapsed > 0
+}
+
+// ForEach calls f on the key and the count of each nonzero bin, in strictly
+// ascending key order, until f returns true.
+func (s *IntStore) ForEach(f func(key int, count uint32) (stop bool)) {
+	for i, b := range s.bins {
+		if b != 0 && f(i+s.minKey, b) {
+			return
+		}
+	}
+}
+
+// ForEachReverse calls f on the key and the count of each nonzero bin, in
+// strictly descending key order, until f returns true.
+func (s *IntStore) ForEachReverse(f func(key int, count uint32) (stop bool)) {
+	for i := len(s.bins) - 1; i >= 0; i-- {
+		if s.bins[i] != 0 && f(i+s.minKey, s.bins[i]) {
+			return
+		}
+	}
+}
+
+// IntBinIterator iterates over the nonzero bins of an IntStore, like
+// BinIterator does over the ones of a Store.
+type IntBinIterator struct {
+	store *IntStore
+	idx   int
+}
+
+// Iterator returns an iterator positioned before the lowest nonzero bin of s.
+func (s *IntStore) Iterator() *IntBinIterator {
+	return &IntBinIterator{store: s, idx: -1}
+}
+
+// Next moves the iterator to the next nonzero bin and returns whether there is
+// one.
+func (it *IntBinIterator) Next() bool {
+	bins := it.store.bins
+	for it.idx++; it.idx < len(bins); it.idx++ {
+		if bins[it.idx] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Key returns the key of the current bin.
+func (it *IntBinIterator) Key() int {
+	return it.idx + it.store.minKey
+}
+
+// Count returns the count of the current bin.
+func (it *IntBinIterator) Count() uint32 {
+	return it.store.bins[it.idx]
+}
+
+// KeyAtRank returns the key for the observation at rank, one being the rank of
+// the lowest one, like Store.KeyAtRank.
+func (s *IntStore) KeyAtRank(rank int) int {
+	return s.KeyAtWeightedRank(float64(rank - 1))
+}
+
+// KeyAtWeightedRank returns the lowest key whose cumulative count is larger than
+// rank, zero being the rank of the lowest observation, like
+// Store.KeyAtWeightedRank.
+func (s *IntStore) KeyAtWeightedRank(rank float64) int {
+	if rank > float64(s.count)/2 {
+		key := s.minKey
+		n := float64(s.count)
+		s.ForEachReverse(func(k int, count uint32) bool {
+			n -= float64(count)
+			if n <= rank {
+				key = k
+				return true
+			}
+			return false
+		})
+		return key
+	}
+	var n float64
+	for i, b := range s.bins {
+		n += float64(b)
+		if n > rank {
+			return i + s.minKey
+		}
+	}
+	return s.maxKey
+}
+
+// KeysAtRanks returns the keys for the observations at ranks, as
+// KeyAtWeightedRank does, in a single pass over the bins like Store.KeysAtRanks.
+func (s *IntStore) KeysAtRanks(ranks []float64) []int {
+	order := make([]int, len(ranks))
+	for i := range order {
+		order[i] = i
+	}
+	slices.SortFunc(order, func(i, j int) int { return cmp.Compare(ranks[i], ranks[j]) })
+	half := float64(s.count) / 2
+	split := sort.Search(len(order), func(i int) bool { return ranks[order[i]] > half })
+	keys := make([]int, len(ranks))
+
+	var n float64
+	j := 0
+	for i := 0; j < split && i < len(s.bins); i++ {
+		if n += float64(s.bins[i]); n > ranks[order[j]] {
+			for ; j < split && n > ranks[order[j]]; j++ {
+				keys[order[j]] = i + s.minKey
+			}
+		}
+	}
+	for ; j < split; j++ {
+		keys[order[j]] = s.maxKey
+	}
+
+	n = float64(s.count)
+	j = len(order) - 1
+	for i := len(s.bins) - 1; j >= split && i >= 0; i-- {
+		if s.bins[i] == 0 {
+			continue
+		}
+		if n -= float64(s.bins[i]); n <= ranks[order[j]] {
+			for ; j >= split && n <= ranks[order[j]]; j-- {
+				keys[order[j]] = i + s.minKey
+			}
+		}
+	}
+	for ; j >= split; j-- {
+		keys[order[j]] = s.minKey
+	}
+	return keys
+}
+
+// Merge adds the bins of o to s, within maxNumBins bins like Store.Merge.
+func (s *IntStore) Merge(o *IntStore) {
+	if o.count == 0 {
+		return
+	}
+	lo, hi := o.minKey, o.maxKey
+	if s.count > 0 {
+		lo, hi = min(lo, s.minKey), max(hi, s.maxKey)
+	}
+	s.GrowTo(lo, hi)
+	var folded uint64
+	o.ForEach(func(key int, count uint32) bool {
+		idx := key - s.minKey
+		added := s.addToBin(max(idx, 0), uint64(count))
+		if idx < 0 {
+			folded += added
+		}
+		return false
+	})
+	// The observations collapsed in o are in its lowest bin, so they are only
+	// new collapses if the folded bins hold more, as in Store.mergeCollapsed.
+	s.collapsed += max64(folded, o.collapsed)
+}
+
+// Subtract removes the counts of o from the bins of s, clamping them to zero,
+// like Store.Subtract. It returns the total count that was removed.
+func (s *IntStore) Subtract(o *IntStore) uint64 {
+	if o.count == 0 || s.count == 0 {
+		return 0
+	}
+	var removed uint64
+	for i, b := range o.bins {
+		key := i + o.minKey
+		if b == 0 || key > s.maxKey {
+			continue
+		}
+		idx := max(key-s.minKey, 0)
+		r := uint32(min64(uint64(b), uint64(s.bins[idx])))
+		s.bins[idx] -= r
+		removed += uint64(r)
+	}
+	s.count -= removed
+	s.collapsed = min64(s.collapsed, uint64(s.bins[0]))
+	if s.count == 0 {
+		s.Clear()
+	}
+	return removed
+}
+
+// ToStore returns a Store with the same bins as s, to be used in a DDSketch.
+func (s *IntStore) ToStore() *Store {
+	store := NewStore(s.maxNumBins)
+	if s.count == 0 {
+		return store
+	}
+	store.GrowTo(s.minKey, s.maxKey)
+	s.ForEach(func(key int, count uint32) bool {
+		store.AddWithCount(key, float64(count))
+		return false
+	})
+	store.collapsed = float64(s.collapsed)
+	return store
+}
+
+// Reweight multiplies the counts of all the bins by w, rounding them to the
+// nearest integer, so that unlike the ones of a Store they drift. It returns an
+// error, leaving the store unmodified, if w is not positive or if it makes a
+// count overflow.
+func (s *IntStore) Reweight(w float64) error {
+	if !(w > 0) {
+		return fmt.Errorf("reweight factor %g is not positive", w)
+	}
+	for i, b := range s.bins {
+		if math.Round(float64(b)*w) > math.MaxUint32 {
+			return fmt.Errorf("reweight overflowed bin %d", i+s.minKey)
+		}
+	}
+	var count uint64
+	for i, b := range s.bins {
+		s.bins[i] = uint32(math.Round(float64(b) * w))
+		count += uint64(s.bins[i])
+	}
+	s.count = count
+	s.collapsed = min64(uint64(math.Round(float64(s.collapsed)*w)), uint64(s.bins[0]))
+	if s.count == 0 {
+		s.Clear()
+	}
+	return nil
+}
+
+// ScaleToCount reweights the bins so that the total count of the store is about
+// target, like Store.ScaleToCount.
+func (s *IntStore) ScaleToCount(target uint64, force bool) error {
+	if target == 0 {
+		return fmt.Errorf("target count %d is not positive", target)
+	}
+	if s.count == 0 || (s.count <= target && !force) {
+		return nil
+	}
+	return s.Reweight(float64(target) / float64(s.count))
+}
+
+// Prune empties the bins whose count is lower than threshold, then trims the
+// store, like Store.Prune. It returns the total count that was removed.
+func (s *IntStore) Prune(threshold uint32) uint64 {
+	var removed uint64
+	kept := false
+	for i, b := range s.bins {
+		if b >= threshold {
+			kept = true
+		} else if b != 0 {
+			removed += uint64(b)
+			s.bins[i] = 0
+			if i == 0 {
+				// The collapsed observations are held by the lowest bin.
+				s.collapsed -= min64(s.collapsed, uint64(b))
+			}
+		}
+	}
+	if removed == 0 {
+		return 0
+	}
+	if !kept {
+		s.Clear()
+		return removed
+	}
+	s.count -= removed
+	s.Trim()
+	return removed
+}
+
+// Trim releases the empty bins below the lowest nonzero bin and above the
+// highest one, like Store.Trim.
+func (s *IntStore) Trim() {
+	if s.count == 0 {
+		return
+	}
+	lo, hi := 0, len(s.bins)-1
+	for lo < hi && s.bins[lo] == 0 {
+		lo++
+	}
+	for hi > lo && s.bins[hi] == 0 {
+		hi--
+	}
+	if lo == 0 && hi == len(s.bins)-1 {
+		return
+	}
+	s.bins = slices.Clone(s.bins[lo : hi+1])
+	s.minKey += lo
+	s.maxKey = s.minKey + hi - lo
+}
+
+// Clear empties the store. The bins are zeroed in place and keep covering the
+// same keys, like Store.Clear.
+func (s *IntStore) Clear() {
+	clear(s.bins)
+	s.count = 0
+	s.collapsed = 0
+}
+
+// ClearAndShrink empties the store and releases its bins, as a new store would
+// hold.
+func (s *IntStore) ClearAndShrink() {
+	s.bins = make([]uint32, initialNumBins)
+	s.count = 0
+	s.collapsed = 0
+	s.minKey = 0
+	s.maxKey = 0
+}
+
+func (s *IntStore) Copy(o *IntStore) {
+	s.bins = slices.Clone(o.bins)
+	s.minKey = o.minKey
+	s.maxKey = o.maxKey
+	s.count = o.count
+	s.collapsed = o.collapsed
+}
+
+func (s *IntStore) MakeCopy() *IntStore {
+	c := *s
+	c.bins = make([]uint32, len(s.bins))
+	copy(c.bins, s.bins)
+	return &c
+}
+
+// Fingerprint returns a hash of the nonzero bins of the store. It is the one
+// of the Store returned by ToStore.
+func (s *IntStore) Fingerprint() uint64 {
+	h := fnv.New64a()
+	s.ForEach(func(key int, count uint32) bool {
+		writeUint64(h, uint64(key))
+		writeUint64(h, math.Float64bits(float64(count)))
+		return false
+	})
+	return h.Sum64()
+}
+
+func (s *IntStore) String() string {
+	var buffer bytes.Buffer
+	buffer.WriteString("{")
+	for i := 0; i < len(s.bins); i++ {
+		key := i + s.minKey
+		buffer.WriteString(fmt.Sprintf("%d: %d, ", key, s.bins[i]))
+	}
+	buffer.WriteString(fmt.Sprintf(", minKey: %d, maxKey: %d}", s.minKey, s.maxKey))
+	return buffer.String()
+}
+
+func (s *IntStore) ApproximateMemoryUsage() int {
+	return int(unsafe.Sizeof(*s)) + cap(s.bins)*int(unsafe.Sizeof(uint32(0)))
+}
+
+func (s *IntStore) Size() int {
+	return s.ApproximateMemoryUsage()
+}
+
+func min64(x, y uint64) uint64 {
+	if x < y {
+		return x
+	}
+	return y
+}
+
+func max64(x, y uint64) uint64 {
+	if x > y {
+		return x
+	}
+	return y
+}
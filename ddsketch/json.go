@@ -0,0 +1,299 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2018 Datadog, Inc.
+
+package ddsketch
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+)
+
+// maxDecodedNumBins bounds the maximum number of bins of the stores decoded
+// into a zero Store or DDSketch, so that a payload cannot make the decoder
+// allocate an arbitrary amount of memory.
+const maxDecodedNumBins = 1 << 16
+
+// logarithmicMapping is the JSON discriminator of the mapping of values to
+// keys that Config implements.
+const logarithmicMapping = "logarithmic"
+
+type jsonConfig struct {
+	Mapping          string  `json:"mapping"`
+	RelativeAccuracy float64 `json:"relativeAccuracy"`
+	Gamma            float64 `json:"gamma"`
+	GammaLn          float64 `json:"gammaLn"`
+	Offset           int     `json:"offset"`
+	MinValue         float64 `json:"minValue"`
+	MaxNumBins       int     `json:"maxNumBins"`
+}
+
+type jsonBin struct {
+	Key   int     `json:"key"`
+	Count float64 `json:"count"`
+}
+
+type jsonStore struct {
+	MaxNumBins int       `json:"maxNumBins"`
+	Bins       []jsonBin `json:"bins"`
+	Collapsed  float64   `json:"collapsed,omitempty"`
+}
+
+type jsonIntBin struct {
+	Key   int    `json:"key"`
+	Count uint32 `json:"count"`
+}
+
+type jsonIntStore struct {
+	MaxNumBins int          `json:"maxNumBins"`
+	Bins       []jsonIntBin `json:"bins"`
+	Collapsed  uint64       `json:"collapsed,omitempty"`
+}
+
+type jsonSketch struct {
+	Config *Config   `json:"config"`
+	Count  float64   `json:"count"`
+	Sum    jsonFloat `json:"sum"`
+	// SumSquares is only set for the sketches that track it exactly.
+	SumSquares *jsonFloat `json:"sumSquares,omitempty"`
+	Min        *jsonFloat `json:"min,omitempty"`
+	Max        *jsonFloat `json:"max,omitempty"`
+	Store      *Store     `json:"store"`
+}
+
+// jsonFloat is a float64 that encodes the values JSON numbers cannot represent,
+// such as a sum that overflowed, as the strings "+Inf", "-Inf" and "NaN".
+type jsonFloat float64
+
+func (f jsonFloat) MarshalJSON() ([]byte, error) {
+	switch v := float64(f); {
+	case math.IsNaN(v):
+		return []byte(`"NaN"`), nil
+	case math.IsInf(v, 1):
+		return []byte(`"+Inf"`), nil
+	case math.IsInf(v, -1):
+		return []byte(`"-Inf"`), nil
+	default:
+		return json.Marshal(v)
+	}
+}
+
+func (f *jsonFloat) UnmarshalJSON(b []byte) error {
+	if len(b) == 0 || b[0] != '"' {
+		return json.Unmarshal(b, (*float64)(f))
+	}
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	switch s {
+	case "NaN":
+		*f = jsonFloat(math.NaN())
+	case "+Inf":
+		*f = jsonFloat(math.Inf(1))
+	case "-Inf":
+		*f = jsonFloat(math.Inf(-1))
+	default:
+		return fmt.Errorf("invalid number %q", s)
+	}
+	return nil
+}
+
+func (c *Config) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonConfig{
+		Mapping:          logarithmicMapping,
+		RelativeAccuracy: (c.gamma - 1) / (c.gamma + 1),
+		Gamma:            c.gamma,
+		GammaLn:          c.gammaLn,
+		Offset:           c.offset,
+		MinValue:         c.minValue,
+		MaxNumBins:       c.maxNumBins,
+	})
+}
+
+func (c *Config) UnmarshalJSON(b []byte) error {
+	var j jsonConfig
+	if err := json.Unmarshal(b, &j); err != nil {
+		return err
+	}
+	if j.Mapping != logarithmicMapping {
+		return fmt.Errorf("unknown mapping %q", j.Mapping)
+	}
+	if !(j.Gamma > 1) || !(j.GammaLn > 0) {
+		return fmt.Errorf("invalid gamma %g", j.Gamma)
+	}
+	if j.MaxNumBins <= 0 {
+		return fmt.Errorf("invalid maximum number of bins %d", j.MaxNumBins)
+	}
+	*c = Config{
+		maxNumBins: j.MaxNumBins,
+		gamma:      j.Gamma,
+		gammaLn:    j.GammaLn,
+		minValue:   j.MinValue,
+		offset:     j.Offset,
+	}
+	return nil
+}
+
+// MarshalJSON encodes the nonzero bins of the store, in ascending key order.
+func (s *Store) MarshalJSON() ([]byte, error) {
+	j := jsonStore{MaxNumBins: s.maxNumBins, Bins: []jsonBin{}, Collapsed: s.collapsed}
+	s.ForEach(func(key int, count float64) bool {
+		j.Bins = append(j.Bins, jsonBin{Key: key, Count: count})
+		return false
+	})
+	return json.Marshal(j)
+}
+
+// UnmarshalJSON decodes a store encoded with MarshalJSON. The bins are grown
+// once, to at most maxNumBins bins, before being filled. If the encoded bins
+// span more keys than that, the lowest ones are collapsed, which is lossy.
+// The encoded maxNumBins may not be larger than the one of s, as set by
+// NewStore, or than 65536 if s is a zero Store.
+func (s *Store) UnmarshalJSON(b []byte) error {
+	var j jsonStore
+	if err := json.Unmarshal(b, &j); err != nil {
+		return err
+	}
+	if j.MaxNumBins <= 0 {
+		return fmt.Errorf("invalid maximum number of bins %d", j.MaxNumBins)
+	}
+	limit := s.maxNumBins
+	if limit <= 0 {
+		limit = maxDecodedNumBins
+	}
+	if j.MaxNumBins > limit {
+		return fmt.Errorf("maximum number of bins %d is larger than the limit %d", j.MaxNumBins, limit)
+	}
+	for _, bin := range j.Bins {
+		if !isValidCount(bin.Count) {
+			return fmt.Errorf("invalid count %g at key %d", bin.Count, bin.Key)
+		}
+	}
+	if !isValidCount(j.Collapsed) {
+		return fmt.Errorf("invalid collapsed count %g", j.Collapsed)
+	}
+	*s = *NewStore(j.MaxNumBins)
+	if len(j.Bins) > 0 {
+		lo, hi := j.Bins[0].Key, j.Bins[0].Key
+		for _, bin := range j.Bins[1:] {
+			lo = min(lo, bin.Key)
+			hi = max(hi, bin.Key)
+		}
+		s.GrowTo(lo, hi)
+	}
+	for _, bin := range j.Bins {
+		s.AddWithCount(bin.Key, bin.Count)
+	}
+	// The encoded collapsed values are in the lowest bin, which is counted
+	// as collapsed along with them if it has been folded.
+	s.collapsed = math.Max(s.collapsed, j.Collapsed)
+	return nil
+}
+
+// isValidCount returns whether count can be decoded as the count of a bin or
+// of a sketch.
+func isValidCount(count float64) bool {
+	return count >= 0 && !math.IsInf(count, 1)
+}
+
+// MarshalJSON encodes the nonzero bins of the store, in ascending key order,
+// with integer counts.
+func (s *IntStore) MarshalJSON() ([]byte, error) {
+	j := jsonIntStore{MaxNumBins: s.maxNumBins, Bins: []jsonIntBin{}, Collapsed: s.collapsed}
+	s.ForEach(func(key int, count uint32) bool {
+		j.Bins = append(j.Bins, jsonIntBin{Key: key, Count: count})
+		return false
+	})
+	return json.Marshal(j)
+}
+
+// UnmarshalJSON decodes a store encoded with MarshalJSON, with the same bounds
+// as Store.UnmarshalJSON.
+func (s *IntStore) UnmarshalJSON(b []byte) error {
+	var j jsonIntStore
+	if err := json.Unmarshal(b, &j); err != nil {
+		return err
+	}
+	if j.MaxNumBins <= 0 {
+		return fmt.Errorf("invalid maximum number of bins %d", j.MaxNumBins)
+	}
+	limit := s.maxNumBins
+	if limit <= 0 {
+		limit = maxDecodedNumBins
+	}
+	if j.MaxNumBins > limit {
+		return fmt.Errorf("maximum number of bins %d is larger than the limit %d", j.MaxNumBins, limit)
+	}
+	*s = *NewIntStore(j.MaxNumBins)
+	if len(j.Bins) > 0 {
+		lo, hi := j.Bins[0].Key, j.Bins[0].Key
+		for _, bin := range j.Bins[1:] {
+			lo = min(lo, bin.Key)
+			hi = max(hi, bin.Key)
+		}
+		s.GrowTo(lo, hi)
+	}
+	for _, bin := range j.Bins {
+		s.AddWithCount(bin.Key, bin.Count)
+	}
+	s.collapsed = max64(s.collapsed, j.Collapsed)
+	return nil
+}
+
+// MarshalJSON encodes the configuration, the summary stats and the nonzero
+// bins of the sketch. Options the sketch was constructed with are not encoded.
+// The stats that are not finite are encoded as strings, like "+Inf".
+func (s *DDSketch) MarshalJSON() ([]byte, error) {
+	j := jsonSketch{Config: s.config, Count: s.count, Sum: jsonFloat(s.sum), Store: s.store}
+	if s.exactSumSquares {
+		j.SumSquares = (*jsonFloat)(&s.sumSquares)
+	}
+	if s.count > 0 {
+		j.Min = (*jsonFloat)(&s.min)
+		j.Max = (*jsonFloat)(&s.max)
+	}
+	return json.Marshal(j)
+}
+
+// UnmarshalJSON decodes a sketch encoded with MarshalJSON. If s has a config,
+// as set by NewDDSketch, the encoded maximum number of bins may not be larger
+// than the one of that config; otherwise it may not be larger than 65536.
+func (s *DDSketch) UnmarshalJSON(b []byte) error {
+	limit := maxDecodedNumBins
+	if s.config != nil {
+		limit = s.config.maxNumBins
+	}
+	// The store is decoded into one that enforces the limit.
+	j := jsonSketch{Store: &Store{maxNumBins: limit}}
+	if err := json.Unmarshal(b, &j); err != nil {
+		return err
+	}
+	if j.Config == nil || j.Store == nil || j.Store.bins == nil {
+		return fmt.Errorf("sketch is missing its config or its store")
+	}
+	if j.Config.maxNumBins > limit {
+		return fmt.Errorf("maximum number of bins %d is larger than the limit %d", j.Config.maxNumBins, limit)
+	}
+	if !isValidCount(j.Count) {
+		return fmt.Errorf("invalid count %g", j.Count)
+	}
+	*s = *NewDDSketch(j.Config)
+	s.store = j.Store
+	s.count = j.Count
+	s.sum = float64(j.Sum)
+	if j.SumSquares != nil {
+		s.sumSquares = float64(*j.SumSquares)
+		s.exactSumSquares = true
+		s.wantExactSumSquares = true
+	}
+	if j.Min != nil {
+		s.min = float64(*j.Min)
+	}
+	if j.Max != nil {
+		s.max = float64(*j.Max)
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2018 Datadog, Inc.
+
+package ddsketch
+
+import (
+	"fmt"
+	"math"
+	"slices"
+)
+
+// The range of scales that OpenTelemetry exponential histograms support.
+const (
+	otlpMinScale = -10
+	otlpMaxScale = 20
+)
+
+// OTLPBuckets holds the buckets of one side of an OpenTelemetry exponential
+// histogram: BucketCounts[i] is the count of the bucket of index Offset+i.
+type OTLPBuckets struct {
+	Offset       int32
+	BucketCounts []uint64
+}
+
+// OTLPExponentialHistogram holds the fields of an OpenTelemetry exponential
+// histogram data point. Bucket i covers (base^i, base^(i+1)] on the positive
+// side and [-base^(i+1), -base^i) on the negative side, with base
+// 2^(2^-Scale). Min and Max are nil when they are unknown.
+type OTLPExponentialHistogram struct {
+	Scale         int32
+	Count         uint64
+	Sum           float64
+	Min           *float64
+	Max           *float64
+	ZeroCount     uint64
+	ZeroThreshold float64
+	Positive      OTLPBuckets
+	Negative      OTLPBuckets
+}
+
+// ToOTLPExponentialHistogram converts sketch to an OpenTelemetry exponential
+// histogram. If the gamma of the sketch is 2^(2^-scale) for a supported scale,
+// as for the sketches built by FromOTLPExponentialHistogram, each bin of the
+// sketch is one bucket of the histogram and the conversion is lossless.
+// Otherwise, the histogram uses the finest scale whose base is larger than
+// gamma, and the bins are assigned to the buckets that hold their
+// representative value, which adds the relative accuracy of that scale to the
+// one of the sketch. The counts are rounded to integers, bin by bin, and Count
+// is their total.
+func ToOTLPExponentialHistogram(sketch *DDSketch) OTLPExponentialHistogram {
+	c := sketch.config
+	scale, exact := otlpScale(c)
+	h := OTLPExponentialHistogram{Scale: scale, Sum: sketch.sum, ZeroThreshold: c.minValue}
+	if sketch.count > 0 {
+		lo, hi := sketch.min, sketch.max
+		h.Min, h.Max = &lo, &hi
+	}
+	multiplier := math.Exp2(float64(scale)) / math.Ln2
+	var positive, negative otlpBucketsBuilder
+	sketch.store.ForEach(func(key int, count float64) bool {
+		n := uint64(math.Round(count))
+		h.Count += n
+		if key == 0 {
+			h.ZeroCount += n
+			return false
+		}
+		var index int
+		if exact {
+			index = abs(key) - c.offset - 1
+		} else {
+			index = int(math.Ceil(math.Log(math.Abs(sketch.value(key)))*multiplier)) - 1
+		}
+		if key > 0 {
+			positive.add(index, n)
+		} else {
+			negative.add(index, n)
+		}
+		return false
+	})
+	h.Positive = positive.build()
+	h.Negative = negative.build()
+	return h
+}
+
+// FromOTLPExponentialHistogram builds a sketch from h. The gamma of the sketch
+// is the base of h, 2^(2^-Scale), so that each bucket of h is exactly one bin of
+// the sketch and the conversion is lossless, as long as maxNumBins covers all
+// the buckets and the zero bucket of h does not overlap nonempty buckets. To
+// be merged with sketches of another configuration, the sketch has to be
+// re-binned with ChangeMapping, which adds the relative accuracy of that
+// configuration to the one of the scale of h. The count of the sketch is the
+// total of the buckets of h. Its min and max are those of h, or are estimated
+// from the bounds of the buckets if h does not have them.
+func FromOTLPExponentialHistogram(h OTLPExponentialHistogram, maxNumBins int) (*DDSketch, error) {
+	if h.Scale < otlpMinScale || h.Scale > otlpMaxScale {
+		return nil, fmt.Errorf("exponential histogram scale %d is not in [%d, %d]", h.Scale, otlpMinScale, otlpMaxScale)
+	}
+	minValue := h.ZeroThreshold
+	if !(minValue > 0) {
+		minValue = defaultMinValue
+	}
+	gammaLn := math.Ln2 * math.Exp2(-float64(h.Scale))
+	c := newConfigWithGamma(math.Exp(gammaLn), gammaLn, maxNumBins, minValue)
+	s := NewDDSketch(c)
+	addOTLPBuckets(s, h.Positive, 1)
+	addOTLPBuckets(s, h.Negative, -1)
+	if h.ZeroCount > 0 {
+		s.store.AddWithCount(0, float64(h.ZeroCount))
+	}
+	s.count = s.store.count
+	if s.count == 0 {
+		return s, nil
+	}
+	s.sum = h.Sum
+	s.min, s.max = math.Inf(-1), math.Inf(1)
+	s.boundMinMaxByBins()
+	if h.Min != nil {
+		s.min = *h.Min
+	}
+	if h.Max != nil {
+		s.max = *h.Max
+	}
+	return s, nil
+}
+
+// addOTLPBuckets adds the buckets of one side of an exponential histogram to
+// the store of s, sign being 1 for the positive side and -1 for the negative
+// one.
+func addOTLPBuckets(s *DDSketch, b OTLPBuckets, sign int) {
+	for i, count := range b.BucketCounts {
+		if count == 0 {
+			continue
+		}
+		key := int(b.Offset) + i + 1 + s.config.offset
+		if key < 1 {
+			// The bucket is within the zero bucket of the sketch.
+			key = 0
+		}
+		s.store.AddWithCount(sign*key, float64(count))
+	}
+}
+
+// otlpScale returns the scale of the exponential histograms that c converts
+// to, and whether the buckets at that scale are the bins of c.
+func otlpScale(c *Config) (int32, bool) {
+	scale := -math.Log2(c.gammaLn / math.Ln2)
+	if rounded := math.Round(scale); math.Abs(scale-rounded) < 1e-9 && rounded >= otlpMinScale && rounded <= otlpMaxScale {
+		return int32(rounded), true
+	}
+	return int32(math.Max(otlpMinScale, math.Min(otlpMaxScale, math.Floor(scale)))), false
+}
+
+// otlpBucketsBuilder collects the counts of the buckets of one side of a
+// histogram, in any order.
+type otlpBucketsBuilder struct {
+	indexes []int
+	counts  []uint64
+}
+
+func (b *otlpBucketsBuilder) add(index int, count uint64) {
+	if count > 0 {
+		b.indexes = append(b.indexes, index)
+		b.counts = append(b.counts, count)
+	}
+}
+
+func (b *otlpBucketsBuilder) build() OTLPBuckets {
+	if len(b.indexes) == 0 {
+		return OTLPBuckets{}
+	}
+	lo, hi := slices.Min(b.indexes), slices.Max(b.indexes)
+	buckets := OTLPBuckets{Offset: int32(lo), BucketCounts: make([]uint64, hi-lo+1)}
+	for i, index := range b.indexes {
+		buckets.BucketCounts[index-lo] += b.counts[i]
+	}
+	return buckets
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
@@ -0,0 +1,36 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2018 Datadog, Inc.
+
+package ddsketch
+
+import "sync"
+
+// Pool recycles sketches that share a configuration and options, to reduce the
+// allocations of pipelines that churn through many short-lived sketches. It is
+// safe for concurrent use.
+type Pool struct {
+	pool sync.Pool
+}
+
+// NewPool returns a pool of sketches constructed with c and opts.
+func NewPool(c *Config, opts ...Option) *Pool {
+	return &Pool{pool: sync.Pool{
+		New: func() any {
+			return NewDDSketch(c, opts...)
+		},
+	}}
+}
+
+// Get returns an empty sketch, either recycled or newly constructed.
+func (p *Pool) Get() *DDSketch {
+	return p.pool.Get().(*DDSketch)
+}
+
+// Put clears s and makes it available to Get. s must have been returned by Get
+// on the same pool, and must not be used after Put.
+func (p *Pool) Put(s *DDSketch) {
+	s.Clear()
+	p.pool.Put(s)
+}
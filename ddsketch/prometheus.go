@@ -0,0 +1,121 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2018 Datadog, Inc.
+
+package ddsketch
+
+import (
+	"fmt"
+	"math"
+)
+
+// ToPrometheusBuckets converts the sketch to the cumulative buckets of a classic
+// Prometheus histogram: buckets[i] is the estimated count of values lower than
+// or equal to upperBounds[i], which must be strictly increasing. total is the
+// count of the implicit +Inf bucket. Each bucket is computed like Rank, so the
+// bins that straddle a bound are split in proportion to their range.
+func ToPrometheusBuckets(sketch *DDSketch, upperBounds []float64) (buckets []float64, total float64, err error) {
+	for i, le := range upperBounds {
+		if math.IsNaN(le) || (i > 0 && le <= upperBounds[i-1]) {
+			return nil, 0, fmt.Errorf("bucket upper bounds are not strictly increasing at %g", le)
+		}
+	}
+	buckets = make([]float64, len(upperBounds))
+	for i, le := range upperBounds {
+		buckets[i] = sketch.Rank(le)
+	}
+	return buckets, sketch.Count(), nil
+}
+
+// PrometheusBucketSpan is a run of consecutive buckets of a native histogram.
+// The offset of the first span is the index of its first bucket; the offset of
+// the following ones is the gap from the end of the previous span.
+type PrometheusBucketSpan struct {
+	Offset int32
+	Length uint32
+}
+
+// PrometheusNativeHistogram holds the fields of a Prometheus native histogram
+// with integer counts. Bucket i covers (base^(i-1), base^i] on the positive
+// side and [-base^i, -base^(i-1)) on the negative side, with base
+// 2^(2^-Schema). The counts of the buckets are delta-encoded, each delta being
+// relative to the count of the previous bucket of the same side.
+type PrometheusNativeHistogram struct {
+	Schema         int32
+	ZeroThreshold  float64
+	ZeroCount      uint64
+	Sum            float64
+	PositiveSpans  []PrometheusBucketSpan
+	PositiveDeltas []int64
+	NegativeSpans  []PrometheusBucketSpan
+	NegativeDeltas []int64
+}
+
+// FromPrometheusNativeHistogram builds a sketch from h. The sketch maps values
+// to the buckets of h, so that the conversion is lossless as long as maxNumBins
+// covers all the buckets, and as long as the zero bucket of h does not overlap
+// nonempty buckets. Its relative accuracy is that of the schema of h; its min
+// and max are estimated from the bounds of the buckets.
+func FromPrometheusNativeHistogram(h PrometheusNativeHistogram, maxNumBins int) (*DDSketch, error) {
+	if h.Schema < -4 || h.Schema > 8 {
+		return nil, fmt.Errorf("native histogram schema %d is not in [-4, 8]", h.Schema)
+	}
+	minValue := h.ZeroThreshold
+	if !(minValue > 0) {
+		minValue = defaultMinValue
+	}
+	gammaLn := math.Ln2 * math.Exp2(-float64(h.Schema))
+	c := newConfigWithGamma(math.Exp(gammaLn), gammaLn, maxNumBins, minValue)
+	s := NewDDSketch(c)
+	if err := addPrometheusBuckets(s, h.PositiveSpans, h.PositiveDeltas, 1); err != nil {
+		return nil, err
+	}
+	if err := addPrometheusBuckets(s, h.NegativeSpans, h.NegativeDeltas, -1); err != nil {
+		return nil, err
+	}
+	if h.ZeroCount > 0 {
+		s.store.AddWithCount(0, float64(h.ZeroCount))
+	}
+	s.count = s.store.count
+	if s.count == 0 {
+		return s, nil
+	}
+	s.sum = h.Sum
+	s.min, s.max = math.Inf(-1), math.Inf(1)
+	s.boundMinMaxByBins()
+	return s, nil
+}
+
+// addPrometheusBuckets adds the buckets of one side of a native histogram to the
+// store of s, sign being 1 for the positive side and -1 for the negative one.
+func addPrometheusBuckets(s *DDSketch, spans []PrometheusBucketSpan, deltas []int64, sign int) error {
+	var index int
+	var count int64
+	for _, span := range spans {
+		index += int(span.Offset)
+		for j := uint32(0); j < span.Length; j++ {
+			if len(deltas) == 0 {
+				return fmt.Errorf("native histogram has fewer deltas than buckets")
+			}
+			count += deltas[0]
+			deltas = deltas[1:]
+			if count < 0 {
+				return fmt.Errorf("native histogram bucket %d has a negative count", index)
+			}
+			key := index + s.config.offset
+			if key < 1 {
+				// The bucket is within the zero bucket of the sketch.
+				key = 0
+			}
+			if count > 0 {
+				s.store.AddWithCount(sign*key, float64(count))
+			}
+			index++
+		}
+	}
+	if len(deltas) > 0 {
+		return fmt.Errorf("native histogram has more deltas than buckets")
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2018 Datadog, Inc.
+
+package ddsketch
+
+import "fmt"
+
+// RollupSet holds named destination sketches, e.g., one per aggregation
+// level, that incoming sketches are merged into.
+type RollupSet struct {
+	sketches map[string]*DDSketch
+}
+
+func NewRollupSet() *RollupSet {
+	return &RollupSet{sketches: make(map[string]*DDSketch)}
+}
+
+// Set registers sketch as the destination called name, replacing any
+// previous one.
+func (r *RollupSet) Set(name string, sketch *DDSketch) {
+	r.sketches[name] = sketch
+}
+
+// Get returns the destination called name, or nil if there is none.
+func (r *RollupSet) Get(name string) *DDSketch {
+	return r.sketches[name]
+}
+
+// AddTo merges src into each of the destinations called names, once per
+// destination, walking the bins of src only once. Nothing is merged if one of
+// the destinations does not exist or is not compatible with src.
+func (r *RollupSet) AddTo(names []string, src *DDSketch) error {
+	dsts := make([]*DDSketch, 0, len(names))
+	seen := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		if _, ok := seen[name]; ok {
+			continue
+		}
+		seen[name] = struct{}{}
+		dst, ok := r.sketches[name]
+		if !ok {
+			return fmt.Errorf("no rollup sketch named %q", name)
+		}
+		if !dst.config.compatible(src.config) {
+			return fmt.Errorf("rollup sketch %q and the source sketch have %w", name, ErrIncompatibleConfig)
+		}
+		dsts = append(dsts, dst)
+	}
+	if src.count == 0 {
+		return nil
+	}
+
+	collapsed := make([]float64, len(dsts))
+	for i, dst := range dsts {
+		collapsed[i] = dst.store.collapsed
+	}
+	src.store.ForEach(func(key int, count float64) bool {
+		for _, dst := range dsts {
+			dst.store.AddWithCount(key, count)
+		}
+		return false
+	})
+	for i, dst := range dsts {
+		dst.store.addCollapsed(src.store, collapsed[i], src.store.collapsed)
+		dst.mergeStats(src)
+	}
+	return nil
+}
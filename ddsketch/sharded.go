@@ -0,0 +1,128 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2018 Datadog, Inc.
+
+package ddsketch
+
+import (
+	"math"
+	"math/rand/v2"
+	"runtime"
+	"sync"
+)
+
+// ShardedDDSketch spreads additions over several sketches, one per available
+// CPU, so that concurrent writers seldom contend for the same lock. Quantile
+// queries merge a snapshot of all the shards, which makes them more expensive
+// than on a DDSketch. It is safe for concurrent use.
+type ShardedDDSketch struct {
+	config *Config
+	opts   []Option
+	shards []shard
+}
+
+type shard struct {
+	mu     sync.Mutex
+	sketch *DDSketch
+	// Keep the shards on separate cache lines.
+	_ [48]byte
+}
+
+// NewShardedDDSketch allocates a new ShardedDDSketch with GOMAXPROCS shards,
+// each configured like NewDDSketch.
+func NewShardedDDSketch(c *Config, opts ...Option) *ShardedDDSketch {
+	s := &ShardedDDSketch{
+		config: c,
+		opts:   opts,
+		shards: make([]shard, runtime.GOMAXPROCS(0)),
+	}
+	for i := range s.shards {
+		s.shards[i].sketch = NewDDSketch(c, opts...)
+	}
+	return s
+}
+
+// Add a new value to one of the shards.
+func (s *ShardedDDSketch) Add(v float64) error {
+	sh := &s.shards[rand.IntN(len(s.shards))]
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	return sh.sketch.Add(v)
+}
+
+// AddWithCount adds count occurrences of value to one of the shards.
+func (s *ShardedDDSketch) AddWithCount(value, count float64) error {
+	sh := &s.shards[rand.IntN(len(s.shards))]
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	return sh.sketch.AddWithCount(value, count)
+}
+
+// Snapshot returns a new DDSketch that holds the values of all the shards,
+// which it leaves unmodified. All the queries of DDSketch are available on the
+// snapshot. It has the options of the shards, except that it notifies no
+// observer: building it is not an event of the sketch.
+func (s *ShardedDDSketch) Snapshot() (*DDSketch, error) {
+	for i := range s.shards {
+		s.shards[i].mu.Lock()
+	}
+	defer func() {
+		for i := range s.shards {
+			s.shards[i].mu.Unlock()
+		}
+	}()
+	sketches := make([]*DDSketch, len(s.shards))
+	for i := range s.shards {
+		sketches[i] = s.shards[i].sketch
+	}
+	snapshot := NewDDSketch(s.config, s.opts...)
+	snapshot.observer = nil
+	snapshot.store.observer = nil
+	if err := MergeAll(snapshot, sketches...); err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+// Quantile returns the estimate of the element at q in a snapshot of the shards,
+// or NaN if the snapshot cannot be taken.
+func (s *ShardedDDSketch) Quantile(q float64) float64 {
+	snapshot, err := s.Snapshot()
+	if err != nil {
+		return math.NaN()
+	}
+	return snapshot.Quantile(q)
+}
+
+func (s *ShardedDDSketch) Quantiles(qs []float64) ([]float64, error) {
+	snapshot, err := s.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	return snapshot.Quantiles(qs)
+}
+
+// Count returns the total count of the shards, each read under its lock.
+func (s *ShardedDDSketch) Count() float64 {
+	var count float64
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.mu.Lock()
+		count += sh.sketch.count
+		sh.mu.Unlock()
+	}
+	return count
+}
+
+// Sum returns the total sum of the shards, each read under its lock.
+func (s *ShardedDDSketch) Sum() float64 {
+	var sum float64
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.mu.Lock()
+		sum += sh.sketch.sum
+		sh.mu.Unlock()
+	}
+	return sum
+}
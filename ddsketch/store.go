@@ -7,8 +7,15 @@ package ddsketch
 
 import (
 	"bytes"
+	"cmp"
+	"encoding/binary"
 	"fmt"
-	"reflect"
+	"hash"
+	"hash/fnv"
+	"math"
+	"slices"
+	"sort"
+	"unsafe"
 )
 
 const (
@@ -19,18 +26,22 @@ const (
 // Store is a dynamically growing contiguous (non-sparse) implementation of
 // the buckets of DogSketch
 type Store struct {
-	bins       []int64
-	count      int64
+	bins       []float64
+	count      float64
 	minKey     int
 	maxKey     int
 	maxNumBins int
+	observer   Observer
+	// collapsed is the number of values that have been folded into the
+	// lowest bin while their keys were lower.
+	collapsed float64
 }
 
 func NewStore(maxNumBins int) *Store {
 	// Start with a small number of bins that will grow as needed
 	// up to maxNumBins
 	return &Store{
-		bins:       make([]int64, initialNumBins),
+		bins:       make([]float64, initialNumBins),
 		count:      0,
 		minKey:     0,
 		maxKey:     0,
@@ -38,136 +49,475 @@ func NewStore(maxNumBins int) *Store {
 	}
 }
 
+// NewStoreWithKeyHint returns a store whose initial bins cover the keys
+// starting at minKey, so that values whose keys are expected to be clustered
+// around minKey and above fill them without reallocating. A bad hint never
+// leads to incorrect results: if the first key added is not covered, the bins
+// are repositioned as they are for a store without a hint.
+func NewStoreWithKeyHint(maxNumBins int, minKey int) *Store {
+	s := NewStore(maxNumBins)
+	s.minKey = minKey
+	s.maxKey = minKey + len(s.bins) - 1
+	return s
+}
+
 func (s *Store) Length() int {
 	return len(s.bins)
 }
 
 func (s *Store) Add(key int) {
-	if s.count == 0 {
+	s.AddWithCount(key, 1)
+}
+
+// AddWithCount adds count observations to the bin at key.
+func (s *Store) AddWithCount(key int, count float64) {
+	if s.count == 0 && (key < s.minKey || key > s.maxKey || s.maxKey-s.minKey+1 != len(s.bins)) {
 		s.maxKey = key
 		s.minKey = key - len(s.bins) + 1
 	}
-	if key < s.minKey {
-		s.growLeft(key)
-	} else if key > s.maxKey {
-		s.growRight(key)
+	if key < s.minKey || key > s.maxKey {
+		s.GrowTo(key, key)
 	}
 	idx := key - s.minKey
 	if idx < 0 {
 		idx = 0
+		s.onCollapse(count)
+	}
+	s.bins[idx] += count
+	s.count += count
+}
+
+// AddBatch adds one observation to the bin of each of keys. The bins are grown
+// once to cover all the keys before being filled.
+func (s *Store) AddBatch(keys []int) {
+	if len(keys) == 0 {
+		return
+	}
+	lo, hi := keys[0], keys[0]
+	for _, key := range keys[1:] {
+		lo = min(lo, key)
+		hi = max(hi, key)
+	}
+	s.GrowTo(lo, hi)
+	var collapsed float64
+	for _, key := range keys {
+		idx := key - s.minKey
+		if idx < 0 {
+			idx = 0
+			collapsed++
+		}
+		s.bins[idx]++
+	}
+	s.count += float64(len(keys))
+	if collapsed > 0 {
+		s.onCollapse(collapsed)
+	}
+}
+
+// Count returns the count of the bin at key, or 0 if key is outside of the bins
+// of the store. The values collapsed below the lowest key are only counted in
+// the count of the lowest bin, not in the ones of their keys.
+func (s *Store) Count(key int) float64 {
+	if s.count == 0 || key < s.minKey || key > s.maxKey {
+		return 0
+	}
+	return s.bins[key-s.minKey]
+}
+
+// NumBins returns the number of nonzero bins of the store.
+func (s *Store) NumBins() int {
+	n := 0
+	for _, b := range s.bins {
+		if b != 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// CumulativeCount returns the total count of the bins whose key is lower than
+// or equal to key.
+func (s *Store) CumulativeCount(key int) float64 {
+	if s.count == 0 || key < s.minKey {
+		return 0
+	}
+	if key >= s.maxKey {
+		return s.count
+	}
+	n := 0.0
+	for _, c := range s.bins[:key-s.minKey+1] {
+		n += c
+	}
+	return n
+}
+
+// CollapsedCount returns the number of values that have been folded into the
+// lowest bin because the store reached its maximum number of bins. The
+// relative accuracy guarantee does not hold for those values.
+func (s *Store) CollapsedCount() float64 {
+	return s.collapsed
+}
+
+// IsCollapsed returns whether some values have been folded into the lowest
+// bin.
+func (s *Store) IsCollapsed() bool {
+	return s.collapsed > 0
+}
+
+// ForEach calls f on the key and the count of each nonzero bin, in strictly
+// ascending key order, until f returns true. The order holds however the store
+// was filled, so callers accumulating a CDF need not sort the bins.
+func (s *Store) ForEach(f func(key int, count float64) (stop bool)) {
+	for i, b := range s.bins {
+		if b != 0 && f(i+s.minKey, b) {
+			return
+		}
+	}
+}
+
+// ForEachReverse calls f on the key and the count of each nonzero bin, in
+// strictly descending key order, until f returns true.
+func (s *Store) ForEachReverse(f func(key int, count float64) (stop bool)) {
+	for i := len(s.bins) - 1; i >= 0; i-- {
+		if s.bins[i] != 0 && f(i+s.minKey, s.bins[i]) {
+			return
+		}
+	}
+}
+
+// BinIterator iterates over the nonzero bins of a store, in strictly ascending
+// key order. Unlike ForEach, it leaves the caller in control of when to move to
+// the next bin, e.g., to walk the bins of two stores side by side. It must not
+// be used once the store has been modified.
+type BinIterator struct {
+	store *Store
+	idx   int
+}
+
+// Iterator returns an iterator positioned before the lowest nonzero bin of s.
+func (s *Store) Iterator() *BinIterator {
+	return &BinIterator{store: s, idx: -1}
+}
+
+// Next moves the iterator to the next nonzero bin and returns whether there is
+// one.
+func (it *BinIterator) Next() bool {
+	bins := it.store.bins
+	for it.idx++; it.idx < len(bins); it.idx++ {
+		if bins[it.idx] != 0 {
+			return true
+		}
 	}
-	s.bins[idx]++
-	s.count++
+	return false
 }
 
-// Return the key for the value at rank
+// Key returns the key of the current bin.
+func (it *BinIterator) Key() int {
+	return it.idx + it.store.minKey
+}
+
+// Count returns the count of the current bin.
+func (it *BinIterator) Count() float64 {
+	return it.store.bins[it.idx]
+}
+
+// Return the key for the value at rank, one being the rank of the smallest
+// value.
 func (s *Store) KeyAtRank(rank int) int {
-	var n int
+	return s.KeyAtWeightedRank(float64(rank - 1))
+}
+
+// KeyAtWeightedRank returns the key of the bin that holds rank, zero being the
+// rank of the smallest value, which accounts for fractional counts: it is the
+// lowest key whose cumulative count is larger than rank. The bins are walked
+// from whichever end is closer to rank.
+func (s *Store) KeyAtWeightedRank(rank float64) int {
+	if rank > s.count/2 {
+		return s.keyAtRankReverse(rank)
+	}
+	var n float64
 	for i, b := range s.bins {
-		n += int(b)
-		if n >= rank {
+		n += b
+		if n > rank {
 			return i + s.minKey
 		}
 	}
 	return s.maxKey
 }
 
-func (s *Store) growLeft(key int) {
-	if s.minKey < key || len(s.bins) >= s.maxNumBins {
-		return
+// keyAtRankReverse is KeyAtWeightedRank walking the bins from the highest key.
+func (s *Store) keyAtRankReverse(rank float64) int {
+	key := s.minKey
+	n := s.count
+	s.ForEachReverse(func(k int, count float64) bool {
+		n -= count
+		if n <= rank {
+			key = k
+			return true
+		}
+		return false
+	})
+	return key
+}
+
+// KeysAtRanks returns the keys for the values at ranks, as KeyAtWeightedRank
+// does,
+// but in a single pass over the bins: the lower half of the ranks is looked up
+// walking up from the lowest key and the upper half walking down from the
+// highest key. The ranks need not be sorted, and the keys are returned in the
+// order of ranks.
+func (s *Store) KeysAtRanks(ranks []float64) []int {
+	order := make([]int, len(ranks))
+	for i := range order {
+		order[i] = i
 	}
+	slices.SortFunc(order, func(i, j int) int { return cmp.Compare(ranks[i], ranks[j]) })
+	split := sort.Search(len(order), func(i int) bool { return ranks[order[i]] > s.count/2 })
+	keys := make([]int, len(ranks))
 
-	var minKey int
-	if s.maxKey-key >= s.maxNumBins {
-		minKey = s.maxKey - s.maxNumBins + 1
-	} else {
-		// Expand bins to the left in chunks of growLeftBy bins.
-		minKey = s.minKey
-		for minKey > key {
-			minKey -= growLeftBy
+	var n float64
+	j := 0
+	for i := 0; j < split && i < len(s.bins); i++ {
+		if n += s.bins[i]; n > ranks[order[j]] {
+			for ; j < split && n > ranks[order[j]]; j++ {
+				keys[order[j]] = i + s.minKey
+			}
 		}
 	}
-	tmpBins := make([]int64, s.maxKey-minKey+1)
-	copy(tmpBins[s.minKey-minKey:], s.bins)
-	s.bins = tmpBins
-	s.minKey = minKey
+	for ; j < split; j++ {
+		keys[order[j]] = s.maxKey
+	}
+
+	n = s.count
+	j = len(order) - 1
+	for i := len(s.bins) - 1; j >= split && i >= 0; i-- {
+		if s.bins[i] == 0 {
+			continue
+		}
+		if n -= s.bins[i]; n <= ranks[order[j]] {
+			for ; j >= split && n <= ranks[order[j]]; j-- {
+				keys[order[j]] = i + s.minKey
+			}
+		}
+	}
+	for ; j >= split; j-- {
+		keys[order[j]] = s.minKey
+	}
+	return keys
 }
 
-func (s *Store) growRight(key int) {
-	if s.maxKey > key {
+// GrowTo grows the bins at once to cover the keys from minKey to maxKey, or as
+// many of the highest of them as maxNumBins allows, so that adding values at
+// those keys does not reallocate them. It does nothing if the bins already cover
+// the keys. If the highest keys push the lowest populated bins out of range,
+// their counts are folded into the lowest bin.
+func (s *Store) GrowTo(minKey, maxKey int) {
+	if s.count == 0 && (maxKey < s.minKey || maxKey > s.maxKey || s.maxKey-s.minKey+1 != len(s.bins)) {
+		s.maxKey = maxKey
+		s.minKey = maxKey - len(s.bins) + 1
+	}
+	if minKey >= s.minKey && maxKey <= s.maxKey {
 		return
 	}
-	if key-s.maxKey >= s.maxNumBins {
-		s.bins = make([]int64, s.maxNumBins)
-		s.maxKey = key
-		s.minKey = key - s.maxNumBins + 1
-		s.bins[0] = int64(s.count)
-	} else if key-s.minKey >= s.maxNumBins {
-		minKey := key - s.maxNumBins + 1
-		var n int64
-		for i := s.minKey; i < minKey && i <= s.maxKey; i++ {
-			n += s.bins[i-s.minKey]
-		}
-		if len(s.bins) < s.maxNumBins {
-			tmpBins := make([]int64, s.maxNumBins)
-			copy(tmpBins, s.bins[minKey-s.minKey:])
-			s.bins = tmpBins
+	lo, hi := s.minKey, max(maxKey, s.maxKey)
+	if maxKey > s.maxKey && maxKey-lo >= s.maxNumBins {
+		lo = maxKey - s.maxNumBins + 1
+	}
+	if minKey < lo && hi-lo+1 < s.maxNumBins {
+		if hi-minKey >= s.maxNumBins {
+			lo = hi - s.maxNumBins + 1
 		} else {
-			copy(s.bins, s.bins[minKey-s.minKey:])
-			for i := s.maxKey - minKey + 1; i < s.maxNumBins; i++ {
-				s.bins[i] = 0.0
+			// Expand bins to the left in chunks of growLeftBy bins, without
+			// going over maxNumBins.
+			for lo > minKey {
+				lo -= growLeftBy
 			}
+			lo = max(lo, hi-s.maxNumBins+1)
 		}
-		s.maxKey = key
-		s.minKey = minKey
-		s.bins[0] += n
+	}
+	s.resize(lo, hi)
+}
+
+// resize moves the bins to cover the keys from lo to hi, folding the bins below
+// lo into the lowest one. It reuses the capacity of the bins when they do not
+// need to be extended to the left.
+func (s *Store) resize(lo, hi int) {
+	var n float64
+	for key := s.minKey; key < lo && key <= s.maxKey; key++ {
+		n += s.bins[key-s.minKey]
+	}
+	length := hi - lo + 1
+	if lo >= s.minKey && length <= cap(s.bins) {
+		bins := s.bins[:length]
+		var copied int
+		if lo <= s.maxKey {
+			copied = copy(bins, s.bins[lo-s.minKey:])
+		}
+		clear(bins[copied:])
+		s.bins = bins
 	} else {
-		tmpBins := make([]int64, key-s.minKey+1)
-		copy(tmpBins, s.bins)
-		s.bins = tmpBins
-		s.maxKey = key
+		bins := make([]float64, length)
+		if lo <= s.maxKey {
+			copy(bins[max(s.minKey-lo, 0):], s.bins[max(lo-s.minKey, 0):])
+		}
+		s.bins = bins
+		s.onGrow()
+	}
+	s.minKey, s.maxKey = lo, hi
+	s.bins[0] += n
+	// The values that were already collapsed are in the folded bins.
+	if n > s.collapsed {
+		s.onCollapse(n - s.collapsed)
 	}
 }
 
+// wouldCollapse returns whether adding values at keys lo to hi would fold some
+// values into the lowest bin, the new ones or the ones already in the store. It
+// follows the steps of GrowTo without modifying the bins.
+func (s *Store) wouldCollapse(lo, hi int) bool {
+	minKey, maxKey := s.minKey, s.maxKey
+	if s.count == 0 && (hi < s.minKey || hi > s.maxKey || s.maxKey-s.minKey+1 != len(s.bins)) {
+		minKey, maxKey = hi-len(s.bins)+1, hi
+	}
+	if hi > maxKey {
+		if hi-minKey >= s.maxNumBins {
+			minKey = hi - s.maxNumBins + 1
+			for key := s.minKey; key < minKey && key <= s.maxKey; key++ {
+				if s.bins[key-s.minKey] != 0 {
+					return true
+				}
+			}
+		}
+		maxKey = hi
+	}
+	return lo < minKey && (maxKey-lo >= s.maxNumBins || maxKey-minKey+1 >= s.maxNumBins)
+}
+
+// addBins adds the bins of o to s, whose bins must already reach the highest
+// populated key of o. The bins of o below the lowest key of s are collapsed.
+func (s *Store) addBins(o *Store) {
+	var collapsed float64
+	for i := o.minKey; i < min(s.minKey, o.maxKey+1); i++ {
+		collapsed += o.bins[i-o.minKey]
+	}
+	// The bins of o above the highest key of s are empty.
+	lo, hi := max(o.minKey, s.minKey), min(o.maxKey, s.maxKey)
+	if lo <= hi {
+		dst := s.bins[lo-s.minKey : hi-s.minKey+1]
+		for i, b := range o.bins[lo-o.minKey : hi-o.minKey+1] {
+			dst[i] += b
+		}
+	}
+	s.bins[0] += collapsed
+	s.count += o.count
+	s.mergeCollapsed(o, collapsed)
+}
+
+func (s *Store) onCollapse(count float64) {
+	s.collapsed += count
+	if s.observer != nil {
+		s.observer.OnCollapse(count)
+	}
+}
+
+func (s *Store) onGrow() {
+	if s.observer != nil {
+		s.observer.OnGrow(cap(s.bins))
+	}
+}
+
+// Merge adds the bins of o to s. The bins of s stay within maxNumBins: if the
+// keys of both stores span more, the lowest ones are collapsed.
 func (s *Store) Merge(o *Store) {
 	if o.count == 0 {
 		return
 	}
-	if s.count == 0 {
-		s.Copy(o)
-		return
+	lo, hi := o.minKey, o.maxKey
+	if s.count > 0 {
+		lo, hi = min(lo, s.minKey), max(hi, s.maxKey)
 	}
+	// Growing the bins to the highest key of o can move the lowest key of s
+	// above some bins of o, which addBins collapses.
+	s.GrowTo(lo, hi)
+	s.addBins(o)
+}
 
-	if s.maxKey > o.maxKey {
-		if o.minKey < s.minKey {
-			s.growLeft(o.minKey)
-		}
-		for i := max(o.minKey, s.minKey); i <= o.maxKey; i++ {
-			s.bins[i-s.minKey] += o.bins[i-o.minKey]
-		}
-		var n int64
-		for i := o.minKey; i < s.minKey; i++ {
-			n += o.bins[i-o.minKey]
-		}
-		s.bins[0] += n
+// mergeCollapsed adds the collapsed values of o to the ones of s, given the
+// count n of the bins of o that have been folded into the lowest bin of s. The
+// values that o had already collapsed are in its lowest bin, so they are only
+// reported as new collapses if n exceeds them.
+func (s *Store) mergeCollapsed(o *Store, n float64) {
+	s.collapsed += o.collapsed
+	if n > o.collapsed {
+		s.onCollapse(n - o.collapsed)
+	}
+}
+
+// addCollapsed counts the oc values that o had collapsed once the bins of o have
+// been added to s with AddWithCount, s having collapsed before values until
+// then. As in mergeCollapsed, they are in the lowest bin of o, so they were
+// already counted if that bin was folded into the lowest bin of s.
+func (s *Store) addCollapsed(o *Store, before, oc float64) {
+	if o.minKey >= s.minKey {
+		s.collapsed += oc
 	} else {
-		if o.minKey < s.minKey {
-			tmpBins := make([]int64, len(o.bins))
-			copy(tmpBins, o.bins)
-			for i := s.minKey; i <= s.maxKey; i++ {
-				tmpBins[i-o.minKey] += s.bins[i-s.minKey]
-			}
-			s.bins = tmpBins
-			s.maxKey = o.maxKey
-			s.minKey = o.minKey
-		} else {
-			s.growRight(o.maxKey)
-			for i := o.minKey; i <= o.maxKey; i++ {
-				s.bins[i-s.minKey] += o.bins[i-o.minKey]
-			}
+		s.collapsed = before + math.Max(s.collapsed-before, oc)
+	}
+}
+
+// Subtract removes the counts of o from the bins of s, clamping them to zero.
+// The counts of o below the lowest key of s are removed from the lowest bin,
+// which holds the collapsed values. It returns the total count that was
+// removed.
+func (s *Store) Subtract(o *Store) float64 {
+	if o.count == 0 || s.count == 0 {
+		return 0
+	}
+	var removed float64
+	for i, b := range o.bins {
+		key := i + o.minKey
+		if b == 0 || key > s.maxKey {
+			continue
 		}
+		idx := max(key-s.minKey, 0)
+		r := math.Min(b, s.bins[idx])
+		s.bins[idx] -= r
+		removed += r
 	}
-	s.count += o.count
+	s.count -= removed
+	s.collapsed = math.Min(s.collapsed, s.bins[0])
+	if !slices.ContainsFunc(s.bins, func(c float64) bool { return c > 0 }) {
+		s.Clear()
+	}
+	return removed
+}
+
+// StoresEqual returns whether a and b hold the same total count and the same
+// count in each bin, up to a relative tolerance. If overlapOnly is true, the
+// bins are only compared on the keys that both stores cover, leaving out the
+// lowest of them, which may hold collapsed counts; this makes it possible to
+// compare a collapsed store to one that is not.
+func StoresEqual(a, b *Store, tolerance float64, overlapOnly bool) bool {
+	if !withinTolerance(a.count, b.count, tolerance) {
+		return false
+	}
+	if a.count == 0 {
+		return true
+	}
+	minKey, maxKey := min(a.minKey, b.minKey), max(a.maxKey, b.maxKey)
+	if overlapOnly {
+		minKey, maxKey = max(a.minKey, b.minKey)+1, min(a.maxKey, b.maxKey)
+	}
+	for key := minKey; key <= maxKey; key++ {
+		if !withinTolerance(a.Count(key), b.Count(key), tolerance) {
+			return false
+		}
+	}
+	return true
+}
+
+func withinTolerance(x, y, tolerance float64) bool {
+	return math.Abs(x-y) <= tolerance*math.Max(math.Abs(x), math.Abs(y))
 }
 
 func max(x, y int) int {
@@ -184,16 +534,126 @@ func min(x, y int) int {
 	return y
 }
 
+// Reweight multiplies the counts of all the bins by w. It returns an error,
+// leaving the store unmodified, if w is not positive or if it makes a count
+// overflow.
+func (s *Store) Reweight(w float64) error {
+	if !(w > 0) {
+		return fmt.Errorf("reweight factor %g is not positive", w)
+	}
+	for i, b := range s.bins {
+		if c := b * w; math.IsInf(c, 0) || math.IsNaN(c) {
+			return fmt.Errorf("reweight overflowed bin %d", i+s.minKey)
+		}
+	}
+	if c := s.count * w; math.IsInf(c, 0) || math.IsNaN(c) {
+		return fmt.Errorf("reweight overflowed the total count")
+	}
+	for i := range s.bins {
+		s.bins[i] *= w
+	}
+	s.count *= w
+	s.collapsed *= w
+	return nil
+}
+
+// ScaleToCount reweights the bins so that the total count of the store is
+// target, preserving the shape of the distribution. Unless force is true, it
+// does nothing if the total count is already lower than or equal to target.
+func (s *Store) ScaleToCount(target float64, force bool) error {
+	if !(target > 0) {
+		return fmt.Errorf("target count %g is not positive", target)
+	}
+	if s.count == 0 || (s.count <= target && !force) {
+		return nil
+	}
+	return s.Reweight(target / s.count)
+}
+
+// Prune empties the bins whose count is lower than threshold, then trims the
+// store. It returns the total count that was removed.
+func (s *Store) Prune(threshold float64) float64 {
+	var removed float64
+	kept := false
+	for i, b := range s.bins {
+		if b >= threshold {
+			kept = true
+		} else if b != 0 {
+			removed += b
+			s.bins[i] = 0
+			if i == 0 {
+				// The collapsed values are held by the lowest bin.
+				s.collapsed -= math.Min(s.collapsed, b)
+			}
+		}
+	}
+	if removed == 0 {
+		return 0
+	}
+	if !kept {
+		s.Clear()
+		return removed
+	}
+	s.count -= removed
+	s.Trim()
+	return removed
+}
+
+// Trim releases the empty bins below the lowest nonzero bin and above the
+// highest one. Empty bins in between are kept since the bins are contiguous.
+func (s *Store) Trim() {
+	if s.count == 0 {
+		return
+	}
+	lo, hi := 0, len(s.bins)-1
+	for lo < hi && s.bins[lo] == 0 {
+		lo++
+	}
+	for hi > lo && s.bins[hi] == 0 {
+		hi--
+	}
+	if lo == 0 && hi == len(s.bins)-1 {
+		return
+	}
+	bins := make([]float64, hi-lo+1)
+	copy(bins, s.bins[lo:hi+1])
+	s.bins = bins
+	s.minKey += lo
+	s.maxKey = s.minKey + hi - lo
+}
+
+// Clear empties the store. The bins are zeroed in place and keep covering the
+// same keys, so that refilling the store with similar values does not
+// reallocate them.
+func (s *Store) Clear() {
+	for i := range s.bins {
+		s.bins[i] = 0
+	}
+	s.count = 0
+	s.collapsed = 0
+}
+
+// ClearAndShrink empties the store and releases its bins, as a new store would
+// hold.
+func (s *Store) ClearAndShrink() {
+	s.bins = make([]float64, initialNumBins)
+	s.count = 0
+	s.collapsed = 0
+	s.minKey = 0
+	s.maxKey = 0
+}
+
 func (s *Store) Copy(o *Store) {
-	s.bins = make([]int64, len(o.bins))
+	s.bins = make([]float64, len(o.bins))
 	copy(s.bins, o.bins)
 	s.minKey = o.minKey
 	s.maxKey = o.maxKey
 	s.count = o.count
+	s.collapsed = o.collapsed
 }
 
 func (s *Store) MakeCopy() *Store {
-	bins := make([]int64, len(s.bins))
+	bins := make([]float64, len(s.bins))
 	copy(bins, s.bins)
 	return &Store{
 		bins:       bins,
@@ -201,20 +661,53 @@ func (s *Store) MakeCopy() *Store {
 		minKey:     s.minKey,
 		maxKey:     s.maxKey,
 		maxNumBins: s.maxNumBins,
+		observer:   s.observer,
+		collapsed:  s.collapsed,
 	}
 }
 
+// Fingerprint returns a hash of the nonzero bins of the store, which only
+// depends on their keys and counts. It is meant to be used as a cache key, not
+// to check integrity.
+func (s *Store) Fingerprint() uint64 {
+	h := fnv.New64a()
+	s.hashBins(h)
+	return h.Sum64()
+}
+
+// hashBins writes the keys and counts of the nonzero bins to h, in ascending
+// key order.
+func (s *Store) hashBins(h hash.Hash64) {
+	s.ForEach(func(key int, count float64) bool {
+		writeUint64(h, uint64(key))
+		writeUint64(h, math.Float64bits(count))
+		return false
+	})
+}
+
+func writeUint64(h hash.Hash64, u uint64) {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], u)
+	h.Write(buf[:])
+}
+
 func (s *Store) String() string {
 	var buffer bytes.Buffer
 	buffer.WriteString("{")
 	for i := 0; i < len(s.bins); i++ {
 		key := i + s.minKey
-		buffer.WriteString(fmt.Sprintf("%d: %d, ", key, s.bins[i]))
+		buffer.WriteString(fmt.Sprintf("%d: %g, ", key, s.bins[i]))
 	}
 	buffer.WriteString(fmt.Sprintf(", minKey: %d, maxKey: %d}", s.minKey, s.maxKey))
 	return buffer.String()
 }
 
+// ApproximateMemoryUsage returns the number of bytes held by the store and its
+// bins.
+func (s *Store) ApproximateMemoryUsage() int {
+	return int(unsafe.Sizeof(*s)) + cap(s.bins)*int(unsafe.Sizeof(float64(0)))
+}
+
 func (s *Store) Size() int {
-	return int(reflect.TypeOf(*s).Size()) + cap(s.bins)*int(reflect.TypeOf(s.bins).Elem().Size())
+	return s.ApproximateMemoryUsage()
 }
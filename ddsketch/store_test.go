@@ -0,0 +1,993 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2018 Datadog, Inc.
+
+package ddsketch
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+
+	"github.com/DataDog/sketches-go/dataset"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStoreClear(t *testing.T) {
+	assert := assert.New(t)
+	s := NewStore(testMaxBins)
+	for key := 0; key < 500; key++ {
+		s.Add(key)
+	}
+	capacity := cap(s.bins)
+	s.Clear()
+	assert.Equal(float64(0), s.count)
+	assert.Equal(capacity, cap(s.bins))
+	for _, b := range s.bins {
+		assert.Equal(float64(0), b)
+	}
+	for key := 499; key >= 0; key-- {
+		s.Add(key)
+	}
+	assert.Equal(capacity, cap(s.bins))
+	assert.Equal(float64(500), s.count)
+	assert.Equal(0, s.KeyAtRank(1))
+	assert.Equal(499, s.KeyAtRank(500))
+	assert.Equal(0, s.KeyAtWeightedRank(0))
+	assert.Equal(499, s.KeyAtWeightedRank(499))
+
+	s.Clear()
+	for key := 1000; key < 1500; key++ {
+		s.Add(key)
+	}
+	assert.Equal(float64(500), s.count)
+	assert.Equal(1000, s.KeyAtRank(1))
+	assert.Equal(1499, s.KeyAtRank(500))
+
+	s.ClearAndShrink()
+	assert.Equal(float64(0), s.count)
+	assert.Equal(initialNumBins, len(s.bins))
+}
+
+func BenchmarkStoreClearAndRefill(b *testing.B) {
+	s := NewStore(defaultMaxNumBins)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for key := 0; key < 1000; key++ {
+			s.Add(key)
+		}
+		s.Clear()
+	}
+}
+
+func BenchmarkStoreClearAndShrinkAndRefill(b *testing.B) {
+	s := NewStore(defaultMaxNumBins)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for key := 0; key < 1000; key++ {
+			s.Add(key)
+		}
+		s.ClearAndShrink()
+	}
+}
+
+func TestStoreFingerprint(t *testing.T) {
+	assert := assert.New(t)
+	s1 := NewStore(testMaxBins)
+	s2 := NewStore(testMaxBins)
+	assert.Equal(s1.Fingerprint(), s2.Fingerprint())
+	for key := 0; key < 200; key += 3 {
+		s1.Add(key)
+	}
+	// Same bins, added in a different order so that they are laid out
+	// differently.
+	for key := 198; key >= 0; key -= 3 {
+		s2.Add(key)
+	}
+	assert.NotEqual(s1.minKey, s2.minKey)
+	assert.Equal(s1.Fingerprint(), s2.Fingerprint())
+	s2.Add(1)
+	assert.NotEqual(s1.Fingerprint(), s2.Fingerprint())
+}
+
+func TestStoreForEach(t *testing.T) {
+	assert := assert.New(t)
+	s := NewStore(testMaxBins)
+	for _, key := range []int{10, -5, 300, 10, 42} {
+		s.Add(key)
+	}
+	var keys []int
+	var counts []float64
+	s.ForEach(func(key int, count float64) bool {
+		keys = append(keys, key)
+		counts = append(counts, count)
+		return false
+	})
+	assert.Equal([]int{-5, 10, 42, 300}, keys)
+	assert.Equal([]float64{1, 2, 1, 1}, counts)
+
+	keys = nil
+	s.ForEach(func(key int, count float64) bool {
+		keys = append(keys, key)
+		return key >= 10
+	})
+	assert.Equal([]int{-5, 10}, keys)
+}
+
+func TestStoreForEachReverse(t *testing.T) {
+	assert := assert.New(t)
+	s := NewStore(testMaxBins)
+	generator := dataset.NewNormal(500, 50)
+	for i := 0; i < 1000; i++ {
+		s.AddWithCount(int(generator.Generate()), float64(1+i%3))
+	}
+
+	var keys, reversedKeys []int
+	var counts, reversedCounts []float64
+	s.ForEach(func(key int, count float64) bool {
+		keys = append(keys, key)
+		counts = append(counts, count)
+		return false
+	})
+	s.ForEachReverse(func(key int, count float64) bool {
+		reversedKeys = append([]int{key}, reversedKeys...)
+		reversedCounts = append([]float64{count}, reversedCounts...)
+		return false
+	})
+	assert.Equal(keys, reversedKeys)
+	assert.Equal(counts, reversedCounts)
+
+	for rank := float64(0); rank < s.count; rank += 0.5 {
+		var n float64
+		expected := s.maxKey
+		for i, c := range counts {
+			n += c
+			if n > rank {
+				expected = keys[i]
+				break
+			}
+		}
+		assert.Equal(expected, s.KeyAtWeightedRank(rank))
+		assert.Equal(expected, s.keyAtRankReverse(rank))
+	}
+}
+
+func TestStoreForEachOrdering(t *testing.T) {
+	assert := assert.New(t)
+	s := NewStore(100)
+	o := NewStore(100)
+	generator := dataset.NewNormal(0, 200)
+	for i := 0; i < 1000; i++ {
+		s.Add(int(generator.Generate()))
+		o.AddWithCount(int(generator.Generate()), 0.5)
+	}
+	s.AddBatch([]int{-1000, 1000, 7})
+	assertOrdered := func() {
+		var keys, reversedKeys []int
+		s.ForEach(func(key int, count float64) bool {
+			keys = append(keys, key)
+			return false
+		})
+		s.ForEachReverse(func(key int, count float64) bool {
+			reversedKeys = append(reversedKeys, key)
+			return false
+		})
+		assert.NotEmpty(keys)
+		for i := 1; i < len(keys); i++ {
+			assert.Less(keys[i-1], keys[i])
+			assert.Greater(reversedKeys[i-1], reversedKeys[i])
+		}
+	}
+	// The store is collapsed at this point.
+	assertOrdered()
+	s.Merge(o)
+	assertOrdered()
+	s.Subtract(o)
+	assertOrdered()
+	s.Prune(1)
+	assertOrdered()
+}
+
+func TestStoreIterator(t *testing.T) {
+	assert := assert.New(t)
+	assert.False(NewStore(testMaxBins).Iterator().Next())
+
+	s1 := NewStore(testMaxBins)
+	s2 := NewStore(testMaxBins)
+	generator := dataset.NewNormal(0, 100)
+	for i := 0; i < 1000; i++ {
+		s1.Add(int(generator.Generate()))
+		s2.AddWithCount(int(generator.Generate())+50, 0.5)
+	}
+	var keys []int
+	var counts []float64
+	s1.ForEach(func(key int, count float64) bool {
+		keys = append(keys, key)
+		counts = append(counts, count)
+		return false
+	})
+	var iterKeys []int
+	var iterCounts []float64
+	for it := s1.Iterator(); it.Next(); {
+		iterKeys = append(iterKeys, it.Key())
+		iterCounts = append(iterCounts, it.Count())
+	}
+	assert.Equal(keys, iterKeys)
+	assert.Equal(counts, iterCounts)
+
+	// Walking two stores side by side merges them.
+	merged := NewStore(testMaxBins)
+	it1, it2 := s1.Iterator(), s2.Iterator()
+	ok1, ok2 := it1.Next(), it2.Next()
+	for ok1 || ok2 {
+		switch {
+		case !ok2 || ok1 && it1.Key() < it2.Key():
+			merged.AddWithCount(it1.Key(), it1.Count())
+			ok1 = it1.Next()
+		case !ok1 || it2.Key() < it1.Key():
+			merged.AddWithCount(it2.Key(), it2.Count())
+			ok2 = it2.Next()
+		default:
+			merged.AddWithCount(it1.Key(), it1.Count()+it2.Count())
+			ok1, ok2 = it1.Next(), it2.Next()
+		}
+	}
+	expected := s1.MakeCopy()
+	expected.Merge(s2)
+	assert.True(StoresEqual(expected, merged, 0, false))
+}
+
+func TestStoreCount(t *testing.T) {
+	assert := assert.New(t)
+	s := NewStore(10)
+	assert.Equal(float64(0), s.Count(0))
+	s.Add(5)
+	s.Add(5)
+	s.AddWithCount(7, 0.5)
+	assert.Equal(float64(2), s.Count(5))
+	assert.Equal(float64(0.5), s.Count(7))
+	assert.Equal(float64(0), s.Count(6))
+	assert.Equal(float64(0), s.Count(1000))
+
+	// Keys 5 and 7 get collapsed into the lowest bin, at key 11.
+	s.Add(20)
+	assert.Equal(float64(2.5), s.Count(11))
+	assert.Equal(float64(0), s.Count(5))
+	assert.Equal(float64(1), s.Count(20))
+}
+
+func TestStoreNumBins(t *testing.T) {
+	assert := assert.New(t)
+	s1 := NewStore(testMaxBins)
+	assert.Equal(0, s1.NumBins())
+	for _, key := range []int{3, 3, 10, 500} {
+		s1.Add(key)
+	}
+	assert.Equal(3, s1.NumBins())
+	s2 := NewStore(testMaxBins)
+	s2.Add(10)
+	s2.Add(11)
+	s1.Merge(s2)
+	assert.Equal(4, s1.NumBins())
+	assert.Nil(s1.Reweight(0.5))
+	assert.Equal(4, s1.NumBins())
+	s1.Prune(1)
+	assert.Equal(2, s1.NumBins())
+}
+
+func TestStoreCumulativeCount(t *testing.T) {
+	assert := assert.New(t)
+	s := NewStore(10)
+	assert.Equal(float64(0), s.CumulativeCount(5))
+	s.Add(5)
+	s.Add(5)
+	s.AddWithCount(7, 0.5)
+	assert.Equal(float64(0), s.CumulativeCount(4))
+	assert.Equal(float64(2), s.CumulativeCount(5))
+	assert.Equal(float64(2), s.CumulativeCount(6))
+	assert.Equal(float64(2.5), s.CumulativeCount(7))
+	assert.Equal(float64(2.5), s.CumulativeCount(1000))
+}
+
+func TestStoreReweight(t *testing.T) {
+	assert := assert.New(t)
+	s := NewStore(testMaxBins)
+	s.Add(3)
+	s.AddWithCount(8, 2)
+	assert.Nil(s.Reweight(1.5))
+	assert.Equal(float64(1.5), s.Count(3))
+	assert.Equal(float64(3), s.Count(8))
+	assert.Equal(float64(4.5), s.count)
+
+	assert.Error(s.Reweight(0))
+	assert.Error(s.Reweight(math.NaN()))
+	err := s.Reweight(math.MaxFloat64)
+	assert.EqualError(err, "reweight overflowed bin 3")
+	// The store is left unmodified.
+	assert.Equal(float64(1.5), s.Count(3))
+	assert.Equal(float64(3), s.Count(8))
+	assert.Equal(float64(4.5), s.count)
+}
+
+func TestStoreScaleToCount(t *testing.T) {
+	assert := assert.New(t)
+	s := NewStore(testMaxBins)
+	assert.Nil(s.ScaleToCount(10, true))
+	assert.Equal(float64(0), s.count)
+
+	s.AddWithCount(1, 30)
+	s.AddWithCount(2, 10)
+	assert.Error(s.ScaleToCount(0, false))
+	assert.Nil(s.ScaleToCount(100, false))
+	assert.Equal(float64(40), s.count)
+
+	assert.Nil(s.ScaleToCount(4, false))
+	assert.InDelta(4, s.count, 1e-12)
+	assert.InDelta(3, s.Count(1), 1e-12)
+	assert.InDelta(1, s.Count(2), 1e-12)
+
+	assert.Nil(s.ScaleToCount(8, true))
+	assert.InDelta(8, s.count, 1e-12)
+	assert.InDelta(6, s.Count(1), 1e-12)
+}
+
+func TestStoresEqual(t *testing.T) {
+	assert := assert.New(t)
+	s1 := NewStore(20)
+	s2 := NewStore(20)
+	assert.True(StoresEqual(s1, s2, 0, false))
+	for key := 0; key < 10; key++ {
+		s1.AddWithCount(key, float64(key+1))
+	}
+	for key := 9; key >= 0; key-- {
+		s2.AddWithCount(key, float64(key+1))
+	}
+	assert.True(StoresEqual(s1, s2, 0, false))
+	s2.AddWithCount(3, 0.001)
+	assert.False(StoresEqual(s1, s2, 0, false))
+	assert.True(StoresEqual(s1, s2, 0.01, false))
+
+	// s3 collapses the lowest keys of s1 into its lowest bin.
+	s3 := NewStore(5)
+	for key := 0; key < 10; key++ {
+		s3.AddWithCount(key, float64(key+1))
+	}
+	assert.False(StoresEqual(s1, s3, 0, false))
+	assert.True(StoresEqual(s1, s3, 0, true))
+	s3.Add(8)
+	assert.False(StoresEqual(s1, s3, 0, true))
+}
+
+func TestStoreApproximateMemoryUsage(t *testing.T) {
+	assert := assert.New(t)
+	s := NewStore(testMaxBins)
+	empty := s.ApproximateMemoryUsage()
+	assert.True(empty >= initialNumBins*8)
+	for key := 0; key < 500; key++ {
+		s.Add(key)
+	}
+	assert.Equal(empty+(cap(s.bins)-initialNumBins)*8, s.ApproximateMemoryUsage())
+}
+
+func TestStoreKeysAtRanks(t *testing.T) {
+	assert := assert.New(t)
+	s := NewStore(testMaxBins)
+	assert.Empty(s.KeysAtRanks(nil))
+	generator := dataset.NewExponential(0.01)
+	for i := 0; i < 1000; i++ {
+		s.Add(int(generator.Generate()))
+	}
+	ranks := []float64{999, 0, 500, 0.5, 250.5, 998.9, 10}
+	keys := s.KeysAtRanks(ranks)
+	for i, rank := range ranks {
+		assert.Equal(s.KeyAtWeightedRank(rank), keys[i])
+	}
+}
+
+var benchmarkRanks = []float64{0.1, 0.25, 0.5, 0.75, 0.9, 0.95, 0.99, 0.999}
+
+func newBenchmarkStore() *Store {
+	s := NewStore(defaultMaxNumBins)
+	for key := 0; key < 1000; key++ {
+		s.AddWithCount(key, 10)
+	}
+	return s
+}
+
+func BenchmarkStoreKeyAtRank(b *testing.B) {
+	s := newBenchmarkStore()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, q := range benchmarkRanks {
+			s.KeyAtWeightedRank(q * (s.count - 1))
+		}
+	}
+}
+
+func BenchmarkStoreKeysAtRanks(b *testing.B) {
+	s := newBenchmarkStore()
+	ranks := make([]float64, len(benchmarkRanks))
+	for i, q := range benchmarkRanks {
+		ranks[i] = q * (s.count - 1)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.KeysAtRanks(ranks)
+	}
+}
+
+func TestStoreWithKeyHint(t *testing.T) {
+	assert := assert.New(t)
+	s := NewStoreWithKeyHint(testMaxBins, 1000)
+	bins := s.bins
+	for key := 1000; key < 1000+initialNumBins; key++ {
+		s.Add(key)
+	}
+	assert.Equal(&bins[0], &s.bins[0])
+	assert.Equal(1000, s.KeyAtRank(1))
+
+	// A bad hint only gets the bins repositioned.
+	s = NewStoreWithKeyHint(testMaxBins, 1000)
+	s.Add(5)
+	s.Add(3)
+	assert.Equal(5, s.maxKey)
+	assert.Equal(float64(2), s.count)
+	assert.Equal(3, s.KeyAtRank(1))
+	assert.Equal(5, s.KeyAtRank(2))
+}
+
+func TestStoreCollapsedCount(t *testing.T) {
+	assert := assert.New(t)
+	s := NewStore(10)
+	for key := 0; key < 10; key++ {
+		s.Add(key)
+	}
+	assert.False(s.IsCollapsed())
+	s.AddWithCount(12, 2)
+	assert.True(s.IsCollapsed())
+	assert.Equal(float64(3), s.CollapsedCount())
+	s.Add(-100)
+	assert.Equal(float64(4), s.CollapsedCount())
+	s.AddWithCount(100, 3)
+	assert.Equal(float64(13), s.CollapsedCount())
+	assert.Equal(float64(16), s.count)
+
+	assert.Nil(s.Reweight(0.5))
+	assert.Equal(float64(6.5), s.CollapsedCount())
+	s.Clear()
+	assert.False(s.IsCollapsed())
+}
+
+func TestStoreWouldCollapse(t *testing.T) {
+	assert := assert.New(t)
+	for _, s := range []*Store{NewStore(200), NewStoreWithKeyHint(200, 1000)} {
+		generator := dataset.NewNormal(0, 80)
+		for i := 0; i < 1000; i++ {
+			lo := int(generator.Generate())
+			hi := lo + int(math.Abs(generator.Generate()))
+			c := s.MakeCopy()
+			c.AddBatch([]int{lo, hi})
+			assert.Equal(c.IsCollapsed(), s.wouldCollapse(lo, hi))
+			c = s.MakeCopy()
+			c.Add(lo)
+			if assert.Equal(c.IsCollapsed(), s.wouldCollapse(lo, lo)) && !c.IsCollapsed() {
+				s.Add(lo)
+				if i%10 == 0 {
+					s.Prune(2)
+				}
+			}
+		}
+		assert.False(s.IsCollapsed())
+	}
+}
+
+func TestStoreMergeCollapsedCount(t *testing.T) {
+	assert := assert.New(t)
+	collapsed := NewStore(10)
+	for key := 0; key < 15; key++ {
+		collapsed.Add(key)
+	}
+	assert.Equal(float64(5), collapsed.CollapsedCount())
+
+	// The collapsed values of o are kept wherever its bins land in s. Only
+	// the value at key 0 is collapsed by the merge itself.
+	for key, expected := range map[int]float64{0: 6, 10: 5, 100: 5} {
+		s := NewStore(10)
+		s.Add(key)
+		s.Merge(collapsed)
+		assert.Equal(float64(16), s.count)
+		assert.Equal(expected, s.CollapsedCount())
+
+		s = NewStore(10)
+		s.Add(key)
+		s.GrowTo(min(key, collapsed.minKey), max(key, collapsed.maxKey))
+		s.addBins(collapsed)
+		assert.Equal(float64(16), s.count)
+		assert.Equal(expected, s.CollapsedCount())
+	}
+	s := NewStore(10)
+	s.Merge(collapsed)
+	assert.Equal(float64(5), s.CollapsedCount())
+}
+
+func TestStoreMergeBelowCollapsedRange(t *testing.T) {
+	assert := assert.New(t)
+	s1 := NewStore(10)
+	s2 := NewStore(10)
+	s1.Add(100)
+	s1.Add(500)
+	s2.AddWithCount(-1000, 2)
+	// All the bins of s2 are below the lowest key s1 can hold.
+	s1.Merge(s2)
+	assert.Equal(float64(4), s1.count)
+	// Key 100 was collapsed when adding 500, then the two values of s2.
+	assert.Equal(float64(3), s1.CollapsedCount())
+	assert.Equal(s1.minKey, s1.KeyAtRank(1))
+	assert.Equal(500, s1.KeyAtRank(4))
+}
+
+func TestStorePrune(t *testing.T) {
+	assert := assert.New(t)
+	s := NewStore(testMaxBins)
+	s.AddWithCount(10, 0.5)
+	s.AddWithCount(20, 5)
+	s.AddWithCount(30, 0.25)
+	s.AddWithCount(40, 3)
+	assert.Equal(float64(0), s.Prune(0.1))
+	assert.Equal(float64(0.75), s.Prune(1))
+	assert.Equal(float64(8), s.count)
+	assert.Equal(20, s.minKey)
+	assert.Equal(40, s.maxKey)
+	assert.Equal(float64(0), s.Count(30))
+	assert.Equal(float64(8), s.Prune(10))
+	assert.Equal(float64(0), s.count)
+}
+
+func TestStoreSubtract(t *testing.T) {
+	assert := assert.New(t)
+	s1 := NewStore(testMaxBins)
+	s2 := NewStore(testMaxBins)
+	s1.AddWithCount(10, 3)
+	s1.AddWithCount(20, 2)
+	s2.AddWithCount(10, 1)
+	s2.AddWithCount(20, 5)
+	s2.AddWithCount(1000, 1)
+	// The count of key 20 is clamped to zero and key 1000 is not in s1.
+	assert.Equal(float64(3), s1.Subtract(s2))
+	assert.Equal(float64(2), s1.count)
+	assert.Equal(float64(2), s1.Count(10))
+	assert.Equal(float64(0), s1.Count(20))
+
+	s3 := NewStore(testMaxBins)
+	s3.AddWithCount(10, 2)
+	assert.Equal(float64(2), s1.Subtract(s3))
+	assert.Equal(float64(0), s1.count)
+	assert.Equal(float64(0), s1.Subtract(s3))
+}
+
+func TestStoreTrim(t *testing.T) {
+	assert := assert.New(t)
+	s1 := NewStore(testMaxBins)
+	s2 := NewStore(testMaxBins)
+	for key := 500; key < 510; key++ {
+		s1.Add(key)
+		s2.AddWithCount(key+200, 2)
+	}
+	s1.Merge(s2)
+	assert.True(s1.minKey < 500)
+	expected := s1.MakeCopy()
+
+	s1.Trim()
+	assert.Equal(500, s1.minKey)
+	assert.Equal(709, s1.maxKey)
+	assert.Equal(210, len(s1.bins))
+	assert.Equal(float64(30), s1.count)
+	assert.True(StoresEqual(expected, s1, 0, false))
+
+	bins := s1.bins
+	s1.Trim()
+	assert.Equal(&bins[0], &s1.bins[0])
+
+	s1.Add(600)
+	s1.Add(100)
+	assert.Equal(float64(1), s1.Count(600))
+	assert.Equal(float64(1), s1.Count(100))
+}
+
+func TestStoreAddBatch(t *testing.T) {
+	assert := assert.New(t)
+	generator := dataset.NewNormal(0, 200)
+	keys := make([]int, 10000)
+	for i := range keys {
+		keys[i] = int(generator.Generate())
+	}
+	s1 := NewStore(testMaxBins * 4)
+	s2 := NewStore(testMaxBins * 4)
+	for _, key := range keys {
+		s1.Add(key)
+	}
+	s2.AddBatch(keys[:5000])
+	s2.AddBatch(nil)
+	s2.AddBatch(keys[5000:])
+	assert.True(StoresEqual(s1, s2, 0, false))
+
+	// Keys that do not fit in maxNumBins bins are collapsed.
+	s3 := NewStore(200)
+	s3.AddBatch([]int{0, 5, 300, 295})
+	assert.Equal(float64(4), s3.count)
+	assert.Equal(float64(2), s3.CollapsedCount())
+	assert.Equal(float64(2), s3.Count(101))
+	assert.Equal(float64(1), s3.Count(300))
+}
+
+func TestStoreGrowTo(t *testing.T) {
+	assert := assert.New(t)
+	o := &testObserver{}
+	s := NewStore(1000)
+	s.observer = o
+	s.AddWithCount(10, 2)
+	s.AddWithCount(-50, 3)
+	grown := o.grown
+	bins := s.bins
+	s.GrowTo(-50, 10)
+	assert.Equal(grown, o.grown)
+	assert.Equal(&bins[0], &s.bins[0])
+
+	s.GrowTo(-400, 300)
+	assert.Equal(grown+1, o.grown)
+	assert.True(s.minKey <= -400 && s.maxKey >= 300)
+	assert.Equal(float64(2), s.Count(10))
+	assert.Equal(float64(3), s.Count(-50))
+	assert.Equal(float64(5), s.count)
+	assert.False(s.IsCollapsed())
+	for _, key := range []int{-400, 300, 0} {
+		s.Add(key)
+	}
+	assert.Equal(grown+1, o.grown)
+
+	// The range is clamped to maxNumBins, folding the lowest bins.
+	s.GrowTo(-1000, 1000)
+	assert.Equal(s.maxNumBins, len(s.bins))
+	assert.Equal(1000, s.maxKey)
+	assert.Equal(float64(8), s.count)
+	assert.Equal(float64(5), s.CollapsedCount())
+	assert.Equal(float64(5), s.Count(s.minKey))
+	assert.Equal(float64(2), s.Count(10))
+	assert.Equal(float64(1), s.Count(300))
+}
+
+func TestStoreGrowToMaxNumBins(t *testing.T) {
+	assert := assert.New(t)
+	s := NewStore(200)
+	s.GrowTo(-150, 10)
+	assert.Equal(200, len(s.bins))
+	assert.Equal(10, s.maxKey)
+
+	// The initial bins of o span more keys than maxNumBins, so growing s to
+	// the highest key of o moves its lowest key above most of them.
+	s = NewStore(10)
+	s.Add(-200)
+	s.Add(-191)
+	o := NewStore(10)
+	o.Add(100)
+	s.Merge(o)
+	assert.Equal(float64(3), s.count)
+	assert.Equal(100, s.maxKey)
+	assert.Equal(float64(2), s.CollapsedCount())
+	assert.True(s.NumBins() <= 10)
+
+	generator := dataset.NewNormal(0, 150)
+	for _, maxNumBins := range []int{50, 200, 1000} {
+		s := NewStore(maxNumBins)
+		var count float64
+		for i := 0; i < 1000; i++ {
+			lo := int(generator.Generate())
+			hi := lo + int(math.Abs(generator.Generate()))
+			o := NewStore(maxNumBins)
+			o.Add(hi)
+			if i%4 != 1 {
+				o.Add(lo)
+			}
+			if i%2 == 0 {
+				s.GrowTo(lo, hi)
+				s.Add(lo)
+				s.Add(hi)
+				count += 2
+			} else {
+				s.Merge(o)
+				count += o.count
+			}
+			assert.True(s.NumBins() <= maxNumBins)
+			assert.True(len(s.bins) <= max(maxNumBins, initialNumBins), "%d bins", len(s.bins))
+			assert.Equal(count, s.count)
+		}
+	}
+}
+
+func mergeSources() []*Store {
+	srcs := make([]*Store, 5)
+	for i := range srcs {
+		srcs[i] = NewStore(defaultMaxNumBins)
+		for key := 0; key < 100; key++ {
+			srcs[i].Add((i+1)*300 + key)
+		}
+	}
+	return srcs
+}
+
+func TestStoreGrowToBeforeMerge(t *testing.T) {
+	assert := assert.New(t)
+	srcs := mergeSources()
+	o1, o2 := &testObserver{}, &testObserver{}
+	s1, s2 := NewStore(defaultMaxNumBins), NewStore(defaultMaxNumBins)
+	s1.observer, s2.observer = o1, o2
+	s1.Add(0)
+	s2.Add(0)
+	s2.GrowTo(0, srcs[len(srcs)-1].maxKey)
+	for _, src := range srcs {
+		s1.Merge(src)
+		s2.Merge(src)
+	}
+	assert.Equal(5, o1.grown)
+	assert.Equal(1, o2.grown)
+	assert.True(StoresEqual(s1, s2, 0, false))
+}
+
+func BenchmarkStoreMerge(b *testing.B) {
+	srcs := mergeSources()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s := NewStore(defaultMaxNumBins)
+		s.Add(0)
+		for _, src := range srcs {
+			s.Merge(src)
+		}
+	}
+}
+
+func BenchmarkStoreMergeGrowTo(b *testing.B) {
+	srcs := mergeSources()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s := NewStore(defaultMaxNumBins)
+		s.Add(0)
+		s.GrowTo(0, srcs[len(srcs)-1].maxKey)
+		for _, src := range srcs {
+			s.Merge(src)
+		}
+	}
+}
+
+func benchmarkKeys() []int {
+	generator := dataset.NewNormal(0, 200)
+	keys := make([]int, 1000000)
+	for i := range keys {
+		keys[i] = int(generator.Generate())
+	}
+	return keys
+}
+
+func BenchmarkStoreAdd(b *testing.B) {
+	keys := benchmarkKeys()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s := NewStore(defaultMaxNumBins)
+		for _, key := range keys {
+			s.Add(key)
+		}
+	}
+}
+
+func BenchmarkStoreAddBatch(b *testing.B) {
+	keys := benchmarkKeys()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s := NewStore(defaultMaxNumBins)
+		s.AddBatch(keys)
+	}
+}
+
+func TestIntStore(t *testing.T) {
+	assert := assert.New(t)
+	s := NewIntStore(testMaxBins * 4)
+	f := NewStore(testMaxBins * 4)
+	generator := dataset.NewNormal(0, 200)
+	for i := 0; i < 10000; i++ {
+		key := int(generator.Generate())
+		s.AddWithCount(key, uint32(1+i%3))
+		f.AddWithCount(key, float64(1+i%3))
+	}
+	assert.Equal(uint64(f.count), s.TotalCount())
+	assert.Equal(f.NumBins(), s.NumBins())
+	assert.Equal(f.Length(), s.Length())
+	assert.False(s.IsCollapsed())
+	for key := f.minKey - 1; key <= f.maxKey+1; key++ {
+		assert.Equal(uint32(f.Count(key)), s.Count(key))
+		assert.Equal(uint64(f.CumulativeCount(key)), s.CumulativeCount(key))
+	}
+	for rank := 0; rank <= int(s.TotalCount()); rank += 97 {
+		assert.Equal(f.KeyAtRank(rank), s.KeyAtRank(rank))
+	}
+	var keys, reversed []int
+	s.ForEach(func(key int, count uint32) bool {
+		keys = append(keys, key)
+		return false
+	})
+	s.ForEachReverse(func(key int, count uint32) bool {
+		reversed = append([]int{key}, reversed...)
+		return false
+	})
+	assert.Equal(keys, reversed)
+	assert.True(StoresEqual(f, s.ToStore(), 0, false))
+
+	b, err := json.Marshal(s)
+	assert.Nil(err)
+	decoded := &IntStore{}
+	assert.Nil(json.Unmarshal(b, decoded))
+	assert.True(StoresEqual(f, decoded.ToStore(), 0, false))
+	assert.Error(json.Unmarshal(b, NewIntStore(testMaxBins)))
+
+	merged := NewIntStore(testMaxBins * 4)
+	merged.Merge(s)
+	merged.Merge(s.MakeCopy())
+	f.Merge(f.MakeCopy())
+	assert.True(StoresEqual(f, merged.ToStore(), 0, false))
+
+	s.Clear()
+	assert.Equal(uint64(0), s.TotalCount())
+	assert.Equal(0, s.NumBins())
+	s.Add(-7)
+	assert.Equal(uint32(1), s.Count(-7))
+	s.ClearAndShrink()
+	assert.Equal(initialNumBins, s.Length())
+
+	// A store cannot have less than one bin.
+	s = NewIntStore(0)
+	s.Add(3)
+	s.Add(5)
+	assert.Equal(uint32(2), s.Count(5))
+	assert.Equal(uint64(1), s.CollapsedCount())
+}
+
+// TestIntStoreMatchesStore checks that an IntStore grows and collapses its bins
+// like a Store given the same observations.
+func TestIntStoreMatchesStore(t *testing.T) {
+	assert := assert.New(t)
+	generator := dataset.NewNormal(0, 100)
+	for _, maxNumBins := range []int{10, 200, 1000} {
+		s, f := NewIntStore(maxNumBins), NewStore(maxNumBins)
+		for i := 0; i < 1000; i++ {
+			key := int(generator.Generate())
+			switch i % 4 {
+			case 0:
+				s.AddWithCount(key, 3)
+				f.AddWithCount(key, 3)
+			case 1:
+				keys := []int{key, key + int(generator.Generate())}
+				s.AddBatch(keys)
+				f.AddBatch(keys)
+			case 2:
+				o, g := NewIntStore(maxNumBins), NewStore(maxNumBins)
+				o.Add(key)
+				o.Add(key - maxNumBins)
+				g.Add(key)
+				g.Add(key - maxNumBins)
+				s.Merge(o)
+				f.Merge(g)
+			default:
+				s.Add(key)
+				f.Add(key)
+			}
+			assert.True(StoresEqual(f, s.ToStore(), 0, false), "%d bins, step %d", maxNumBins, i)
+			assert.Equal(f.Length(), s.Length())
+			assert.Equal(uint64(f.CollapsedCount()), s.CollapsedCount())
+		}
+	}
+
+	// Descending keys grow the bins to the left in chunks, like a Store.
+	s, f := NewIntStore(10000), NewStore(10000)
+	for key := 0; key > -10000; key-- {
+		s.Add(key)
+		f.Add(key)
+	}
+	assert.Equal(f.Length(), s.Length())
+	assert.Equal(f.minKey, s.minKey)
+}
+
+// TestIntStoreMethodsMatchStore checks that the methods that IntStore shares
+// with Store give the same results on the same observations.
+func TestIntStoreMethodsMatchStore(t *testing.T) {
+	assert := assert.New(t)
+	generator := dataset.NewNormal(0, 100)
+	fill := func(maxNumBins int) (*IntStore, *Store) {
+		s, f := NewIntStore(maxNumBins), NewStore(maxNumBins)
+		for i := 0; i < 1000; i++ {
+			key := int(generator.Generate())
+			s.AddWithCount(key, uint32(1+i%4))
+			f.AddWithCount(key, float64(1+i%4))
+		}
+		return s, f
+	}
+	for _, maxNumBins := range []int{10, 200, 1000} {
+		s, f := fill(maxNumBins)
+		var ranks []float64
+		for rank := 0.0; rank < float64(s.TotalCount()); rank += 37.5 {
+			ranks = append(ranks, rank)
+			assert.Equal(f.KeyAtWeightedRank(rank), s.KeyAtWeightedRank(rank))
+		}
+		assert.Equal(f.KeysAtRanks(ranks), s.KeysAtRanks(ranks))
+		assert.Equal(f.Fingerprint(), s.Fingerprint())
+
+		it, fit := s.Iterator(), f.Iterator()
+		for fit.Next() {
+			assert.True(it.Next())
+			assert.Equal(fit.Key(), it.Key())
+			assert.Equal(uint32(fit.Count()), it.Count())
+		}
+		assert.False(it.Next())
+
+		o, g := fill(maxNumBins)
+		assert.Equal(uint64(f.Subtract(g)), s.Subtract(o))
+		assert.True(StoresEqual(f, s.ToStore(), 0, false))
+		assert.Equal(uint64(f.CollapsedCount()), s.CollapsedCount())
+
+		s, f = fill(maxNumBins)
+		assert.Nil(s.Reweight(4))
+		assert.Nil(f.Reweight(4))
+		assert.True(StoresEqual(f, s.ToStore(), 0, false))
+		assert.Equal(uint64(f.CollapsedCount()), s.CollapsedCount())
+		assert.Nil(s.ScaleToCount(s.TotalCount()/2, false))
+		assert.Nil(f.ScaleToCount(f.count/2, false))
+		assert.True(StoresEqual(f, s.ToStore(), 0, false))
+
+		assert.Equal(uint64(f.Prune(10)), s.Prune(10))
+		assert.True(StoresEqual(f, s.ToStore(), 0, false))
+		assert.Equal(f.minKey, s.minKey)
+		assert.Equal(f.maxKey, s.maxKey)
+		assert.Equal(uint64(f.CollapsedCount()), s.CollapsedCount())
+	}
+	s := NewIntStore(10)
+	s.AddWithCount(1, math.MaxUint32)
+	assert.Error(s.Reweight(2))
+	assert.Equal(uint32(math.MaxUint32), s.Count(1))
+	assert.Error(s.Reweight(0))
+}
+
+func TestIntStoreSaturation(t *testing.T) {
+	assert := assert.New(t)
+	s := NewIntStore(10)
+	s.AddWithCount(1, math.MaxUint32)
+	s.AddWithCount(1, 5)
+	assert.Equal(uint32(math.MaxUint32), s.Count(1))
+	assert.Equal(uint64(math.MaxUint32), s.TotalCount())
+}
+
+func benchmarkStoreMemory(b *testing.B, usage func(keys []int) int) {
+	keys := make([]int, 10000)
+	for i := range keys {
+		keys[i] = i
+	}
+	b.ResetTimer()
+	var bytes int
+	for i := 0; i < b.N; i++ {
+		bytes = usage(keys)
+	}
+	b.ReportMetric(float64(bytes), "bytes/store")
+}
+
+func BenchmarkStoreMemory10kBins(b *testing.B) {
+	benchmarkStoreMemory(b, func(keys []int) int {
+		s := NewStore(len(keys))
+		s.AddBatch(keys)
+		return s.ApproximateMemoryUsage()
+	})
+}
+
+func BenchmarkIntStoreMemory10kBins(b *testing.B) {
+	benchmarkStoreMemory(b, func(keys []int) int {
+		s := NewIntStore(len(keys))
+		s.AddBatch(keys)
+		return s.ApproximateMemoryUsage()
+	})
+}
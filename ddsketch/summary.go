@@ -0,0 +1,132 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2018 Datadog, Inc.
+
+package ddsketch
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// summaryQuantiles are the quantiles precomputed by EncodeSummary.
+var summaryQuantiles = []float64{0.5, 0.75, 0.9, 0.95, 0.99}
+
+var errSummaryTruncated = errors.New("summary payload is truncated")
+
+// SummaryStats holds the summary statistics of a sketch, as decoded by
+// DecodeSummary.
+type SummaryStats struct {
+	Count     float64
+	Sum       float64
+	Min       float64
+	Max       float64
+	Quantiles []QuantileValue
+}
+
+// EncodeSummary appends to b the count, sum, min and max of the sketch, along
+// with a handful of precomputed quantiles, but not the bins themselves.
+func (s *DDSketch) EncodeSummary(b *[]byte) {
+	var rows []QuantileValue
+	if s.count > 0 {
+		rows, _ = s.QuantileTable(summaryQuantiles, false)
+	}
+	*b = appendFloat64(*b, s.count)
+	*b = appendFloat64(*b, s.sum)
+	*b = appendFloat64(*b, s.min)
+	*b = appendFloat64(*b, s.max)
+	*b = binary.AppendUvarint(*b, uint64(len(rows)))
+	for _, row := range rows {
+		*b = appendFloat64(*b, row.Quantile)
+		*b = appendFloat64(*b, row.Value)
+	}
+}
+
+// DecodeSummary decodes summary statistics that were encoded with
+// EncodeSummary.
+func DecodeSummary(b []byte) (SummaryStats, error) {
+	var stats SummaryStats
+	var err error
+	for _, f := range []*float64{&stats.Count, &stats.Sum, &stats.Min, &stats.Max} {
+		if *f, b, err = decodeFloat64(b); err != nil {
+			return SummaryStats{}, err
+		}
+	}
+	n, l := binary.Uvarint(b)
+	if l <= 0 || n > uint64(len(b[l:])/16) {
+		return SummaryStats{}, errSummaryTruncated
+	}
+	b = b[l:]
+	stats.Quantiles = make([]QuantileValue, n)
+	for i := range stats.Quantiles {
+		row := &stats.Quantiles[i]
+		row.Quantile, b, _ = decodeFloat64(b)
+		row.Value, b, _ = decodeFloat64(b)
+	}
+	return stats, nil
+}
+
+func appendFloat64(b []byte, f float64) []byte {
+	return binary.LittleEndian.AppendUint64(b, math.Float64bits(f))
+}
+
+func decodeFloat64(b []byte) (float64, []byte, error) {
+	if len(b) < 8 {
+		return 0, b, errSummaryTruncated
+	}
+	return math.Float64frombits(binary.LittleEndian.Uint64(b)), b[8:], nil
+}
+
+// SummaryResult holds the statistics that reports usually show together, as
+// computed by Summary.
+type SummaryResult struct {
+	Count  float64
+	Sum    float64
+	Min    float64
+	Max    float64
+	Mean   float64
+	StdDev float64
+	P50    float64
+	P90    float64
+	P95    float64
+	P99    float64
+	// Quantiles holds the estimates of the quantiles passed to Summary, in
+	// their order.
+	Quantiles []QuantileValue
+}
+
+// Summary computes the summary statistics of sketch, with the estimates of
+// quantiles on top of the fixed percentiles. All the quantiles are estimated in
+// a single call to Quantiles. The standard deviation is exact if the sketch
+// tracks its sum of squares; otherwise StdDev estimates it from the bins, in
+// another walk of them.
+func Summary(sketch *DDSketch, quantiles []float64) (SummaryResult, error) {
+	qs := append([]float64{0.5, 0.9, 0.95, 0.99}, quantiles...)
+	values, err := sketch.Quantiles(qs)
+	if err != nil {
+		return SummaryResult{}, err
+	}
+	stdDev, err := sketch.StdDev()
+	if err != nil {
+		return SummaryResult{}, err
+	}
+	r := SummaryResult{
+		Count:     sketch.count,
+		Sum:       sketch.sum,
+		Min:       sketch.min,
+		Max:       sketch.max,
+		Mean:      sketch.Avg(),
+		StdDev:    stdDev,
+		P50:       values[0],
+		P90:       values[1],
+		P95:       values[2],
+		P99:       values[3],
+		Quantiles: make([]QuantileValue, len(quantiles)),
+	}
+	for i, q := range quantiles {
+		r.Quantiles[i] = QuantileValue{Quantile: q, Value: values[4+i]}
+	}
+	return r, nil
+}